@@ -16,8 +16,14 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/spf13/cobra"
 
@@ -31,16 +37,89 @@ var cfgFile string
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   "proxysocket inbound outbound",
+	Use:   "proxysocket [inbound [outbound]]",
 	Short: "Another socket proxy",
-	Long:  `This proxy support tcp, udp and unix socket, like: tcp://127.0.0.1:80`,
-	Args:  cobra.MinimumNArgs(2),
+	Long: `This proxy support tcp, udp and unix socket, like: tcp://127.0.0.1:80
+
+Tunnels can be given by arguments, or listed under "tunnels" in config file.
+The outbound is omitted for socks5 and http-connect inbound, the destination comes from client.`,
+	Args: cobra.MaximumNArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		pc := lib.ProxyChainTunnel{InAddr: args[0], OutAddr: args[1]}
-		pc.Serve()
+		cfg, tunnels, err := loadTunnels(args)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if cfg.ReadyAddr != "" {
+			srv, err := lib.ListenReady(cfg.ReadyAddr)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			defer srv.Close()
+		}
+
+		// Tunnels are stopped and drained by signals, a second signal kills at once
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
+
+		var failed int32
+		wg := sync.WaitGroup{}
+		for _, pc := range tunnels {
+			wg.Add(1)
+			go func(pc lib.ProxyChainTunnel) {
+				defer wg.Done()
+				if err := pc.Run(ctx); err != nil {
+					fmt.Printf("tunnel %s: %s\n", pc.Name, err)
+					atomic.StoreInt32(&failed, 1)
+				}
+			}(pc)
+		}
+		wg.Wait()
+		lib.AllDialerPools.Close()
+
+		if atomic.LoadInt32(&failed) != 0 {
+			os.Exit(1)
+		}
 	},
 }
 
+// loadTunnels merge tunnel from arguments and tunnels from config file
+func loadTunnels(args []string) (*lib.Config, []lib.ProxyChainTunnel, error) {
+	cfg := &lib.Config{}
+	if err := viper.Unmarshal(cfg); err != nil {
+		return nil, nil, err
+	}
+
+	if len(args) == 1 {
+		cfg.Tunnels = append(cfg.Tunnels, lib.TunnelConfig{Name: "default", In: args[0]})
+	} else if len(args) == 2 {
+		cfg.Tunnels = append(cfg.Tunnels, lib.TunnelConfig{Name: "default", In: args[0], Out: args[1]})
+	}
+
+	if len(cfg.Tunnels) == 0 {
+		return nil, nil, errors.New("no tunnel to start, give inbound and outbound or a config file")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	lib.SetMaxConns(cfg.MaxConns)
+
+	tunnels := make([]lib.ProxyChainTunnel, 0, len(cfg.Tunnels))
+	for i := range cfg.Tunnels {
+		t := cfg.Tunnels[i].Tunnel()
+		t.DrainTimeout = cfg.DrainTimeout
+		tunnels = append(tunnels, t)
+	}
+	return cfg, tunnels, nil
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -84,5 +163,9 @@ func initConfig() {
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	} else if cfgFile != "" {
+		// The config file given by flag must be readable
+		fmt.Println(err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Access control of an inbound by options, like:
+//
+//	tcp://0.0.0.0:53?allow=10.0.0.0/8,192.168.1.5&deny=10.0.3.0/24
+//	unix:///run/dns.sock?allow=uid:0,gid:1001&deny=pid:4242
+//
+// tcp and udp clients are matched by ip or cidr, unix clients by peer credentials
+// uid, gid or pid (SO_PEERCRED, only on linux). A client matching any deny rule is
+// refused, then if allow is given, a client matching no allow rule is refused.
+// With proxy_protocol, the client address in the header is matched, and proxy_allow
+// lists the proxies sending headers, like:
+//
+//	tcp://0.0.0.0:80?proxy_protocol=v1&proxy_allow=10.0.0.2,10.0.0.3&allow=203.0.113.0/24
+//
+// A connection from a peer not in proxy_allow is refused before its header is read.
+// The rules are only options of inbound addresses.
+
+// aclRule a cidr, or a uid, gid or pid of unix peer
+type aclRule struct {
+	ipnet *net.IPNet
+	kind  string
+	id    int
+}
+
+// aclOptions the options of access list
+var aclOptions = []string{"allow", "deny", "proxy_allow"}
+
+// accessList allow and deny rules of an inbound, and the proxies allowed to send PROXY headers
+type accessList struct {
+	allow   []aclRule
+	deny    []aclRule
+	proxies []aclRule
+
+	denied *Counter
+}
+
+// parseAccessList parse allow and deny options, nil if no rules
+func parseAccessList(options url.Values) (*accessList, error) {
+	acl := &accessList{}
+	for key, rules := range map[string]*[]aclRule{"allow": &acl.allow, "deny": &acl.deny, "proxy_allow": &acl.proxies} {
+		v := options.Get(key)
+		if v == "" {
+			continue
+		}
+		for _, s := range strings.Split(v, ",") {
+			r, err := parseACLRule(strings.TrimSpace(s))
+			if err != nil {
+				return nil, errors.New(key + ": " + err.Error())
+			}
+			*rules = append(*rules, r)
+		}
+	}
+	if len(acl.allow) == 0 && len(acl.deny) == 0 && len(acl.proxies) == 0 {
+		return nil, nil
+	}
+	return acl, nil
+}
+
+// parseACLRule parse a rule like: 10.0.0.0/8, 10.0.0.1, uid:1000
+func parseACLRule(s string) (aclRule, error) {
+	for _, kind := range []string{"uid", "gid", "pid"} {
+		if !strings.HasPrefix(s, kind+":") {
+			continue
+		}
+		id, err := strconv.Atoi(s[len(kind)+1:])
+		if err != nil || id < 0 {
+			return aclRule{}, errors.New("invalid " + kind + ": " + s)
+		}
+		return aclRule{kind: kind, id: id}, nil
+	}
+
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return aclRule{}, errors.New("invalid ip: " + s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return aclRule{ipnet: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return aclRule{}, errors.New("invalid cidr: " + s)
+	}
+	return aclRule{ipnet: ipnet}, nil
+}
+
+// checkAccessList check the rules fit the inbound, cidr for tcp and udp, peer credentials for unix
+func checkAccessList(pa *ProxyProtoAddr) error {
+	acl, err := parseAccessList(pa.Options)
+	if err != nil || acl == nil {
+		return err
+	}
+	for _, r := range append(append(acl.allow, acl.deny...), acl.proxies...) {
+		if pa.IsUnix && r.ipnet != nil {
+			return errors.New("cidr rule on unix address: " + r.ipnet.String())
+		}
+		if !pa.IsUnix && r.ipnet == nil {
+			return errors.New(r.kind + " rule only on unix address")
+		}
+		if r.ipnet == nil && !peerCredSupported {
+			return errors.New("peer credentials not supported on this platform")
+		}
+	}
+	if len(acl.proxies) > 0 && (pa.Options.Get("proxy_protocol") == "" || pa.IsUnix) {
+		return errors.New("proxy_allow only on tcp address with proxy_protocol")
+	}
+	return nil
+}
+
+// hasAccessList any access list option on the address or the proxies before it
+func hasAccessList(pa *ProxyProtoAddr) bool {
+	for _, key := range aclOptions {
+		if pa.Options.Get(key) != "" {
+			return true
+		}
+	}
+	for _, hop := range pa.Via {
+		if hasAccessList(hop) {
+			return true
+		}
+	}
+	return false
+}
+
+// newAccessList the access list of inbound, nil if no rules
+func newAccessList(addr *ProxyProtoAddr) *accessList {
+	acl, err := parseAccessList(addr.Options)
+	if err != nil || acl == nil {
+		return nil
+	}
+	acl.denied = GetCounter(addr.Addr + ".acl_denied")
+	return acl
+}
+
+// allowAddr match the ip of a tcp or udp client
+func (acl *accessList) allowAddr(addr net.Addr) bool {
+	if acl == nil {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	return acl.allowed(func(r aclRule) bool {
+		return ip != nil && r.ipnet != nil && r.ipnet.Contains(ip)
+	})
+}
+
+// allowProxy match the peer of a connection sending PROXY header, any peer without proxy_allow
+func (acl *accessList) allowProxy(conn net.Conn) bool {
+	if acl == nil || len(acl.proxies) == 0 {
+		return true
+	}
+	var ip net.IP
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = a.IP
+	}
+	for _, r := range acl.proxies {
+		if ip != nil && r.ipnet.Contains(ip) {
+			return true
+		}
+	}
+	acl.denied.Add(1)
+	return false
+}
+
+// allowConn match the client of a connection, by peer credentials if unix
+func (acl *accessList) allowConn(conn net.Conn) bool {
+	if acl == nil {
+		return true
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return acl.allowAddr(conn.RemoteAddr())
+	}
+
+	cred, err := getPeerCred(uc)
+	if err != nil {
+		log.Errorf("get peer credentials of %s failed: %s", conn.LocalAddr(), err)
+		acl.denied.Add(1)
+		return false
+	}
+	return acl.allowed(func(r aclRule) bool {
+		switch r.kind {
+		case "uid":
+			return r.id == cred.uid
+		case "gid":
+			return r.id == cred.gid
+		case "pid":
+			return r.id == cred.pid
+		}
+		return false
+	})
+}
+
+// allowed refuse if any deny rule matched, then accept if no allow rules or any matched
+func (acl *accessList) allowed(match func(aclRule) bool) bool {
+	for _, r := range acl.deny {
+		if match(r) {
+			acl.denied.Add(1)
+			return false
+		}
+	}
+	if len(acl.allow) == 0 {
+		return true
+	}
+	for _, r := range acl.allow {
+		if match(r) {
+			return true
+		}
+	}
+	acl.denied.Add(1)
+	return false
+}
+
+// peerCred credentials of the process of unix peer
+type peerCred struct {
+	uid int
+	gid int
+	pid int
+}
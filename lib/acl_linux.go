@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package lib
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredSupported SO_PEERCRED of linux
+const peerCredSupported = true
+
+// getPeerCred read SO_PEERCRED of unix connection
+func getPeerCred(conn *net.UnixConn) (*peerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &peerCred{uid: int(ucred.Uid), gid: int(ucred.Gid), pid: int(ucred.Pid)}, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package lib
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredSupported peer credentials rules only on linux
+const peerCredSupported = false
+
+// getPeerCred not supported
+func getPeerCred(conn *net.UnixConn) (*peerCred, error) {
+	return nil, errors.New("peer credentials not supported on this platform")
+}
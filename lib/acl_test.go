@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseACLRule(t *testing.T) {
+	tests := []struct {
+		rule  string
+		ipnet string
+		kind  string
+		id    int
+		err   string
+	}{
+		{rule: "10.0.0.0/8", ipnet: "10.0.0.0/8"},
+		{rule: "10.1.2.3/8", ipnet: "10.0.0.0/8"},
+		{rule: "192.168.1.5", ipnet: "192.168.1.5/32"},
+		{rule: "2001:db8::/32", ipnet: "2001:db8::/32"},
+		{rule: "2001:db8::1", ipnet: "2001:db8::1/128"},
+		{rule: "uid:0", kind: "uid", id: 0},
+		{rule: "gid:1001", kind: "gid", id: 1001},
+		{rule: "pid:4242", kind: "pid", id: 4242},
+		{rule: "uid:-1", err: "invalid uid"},
+		{rule: "gid:x", err: "invalid gid"},
+		{rule: "pid:", err: "invalid pid"},
+		{rule: "10.0.0", err: "invalid ip"},
+		{rule: "10.0.0.0/33", err: "invalid cidr"},
+		{rule: "user:1", err: "invalid ip"},
+	}
+	for _, tt := range tests {
+		r, err := parseACLRule(tt.rule)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.rule, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.rule, err)
+			continue
+		}
+		if tt.ipnet != "" && (r.ipnet == nil || r.ipnet.String() != tt.ipnet) {
+			t.Errorf("%s: cidr %v, want %s", tt.rule, r.ipnet, tt.ipnet)
+		}
+		if r.kind != tt.kind || r.id != tt.id {
+			t.Errorf("%s: %s %d, want %s %d", tt.rule, r.kind, r.id, tt.kind, tt.id)
+		}
+	}
+}
+
+func TestAccessListAllowed(t *testing.T) {
+	tests := []struct {
+		query   string
+		client  string
+		allowed bool
+	}{
+		{"allow=10.0.0.0/8", "10.1.2.3", true},
+		{"allow=10.0.0.0/8", "192.168.1.1", false},
+		{"deny=10.0.3.0/24", "10.0.3.7", false},
+		{"deny=10.0.3.0/24", "10.0.4.7", true},
+		{"allow=10.0.0.0/8&deny=10.0.3.0/24", "10.0.3.7", false},
+		{"allow=10.0.0.0/8&deny=10.0.3.0/24", "10.0.4.7", true},
+		{"allow=10.0.0.0/8,192.168.1.5", "192.168.1.5", true},
+		{"allow=192.168.1.5", "192.168.1.6", false},
+		{"allow=2001:db8::/32", "2001:db8::7", true},
+		{"allow=2001:db8::/32", "10.0.0.1", false},
+		// An ipv4 client of a dual-stack socket
+		{"allow=10.0.0.0/8", "::ffff:10.0.0.1", true},
+	}
+	for _, tt := range tests {
+		options, _ := url.ParseQuery(tt.query)
+		acl, err := parseAccessList(options)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		acl.denied = GetCounter(t.Name() + ".acl_denied")
+		denied := acl.denied.Value()
+
+		client := &net.TCPAddr{IP: net.ParseIP(tt.client), Port: 4000}
+		if got := acl.allowAddr(client); got != tt.allowed {
+			t.Errorf("%s %s: allowed %v, want %v", tt.query, tt.client, got, tt.allowed)
+		}
+		if counted := acl.denied.Value() - denied; counted != 0 == tt.allowed {
+			t.Errorf("%s %s: %d denials counted", tt.query, tt.client, counted)
+		}
+	}
+
+	// No rules, no access list
+	if acl, err := parseAccessList(url.Values{}); acl != nil || err != nil {
+		t.Fatalf("empty access list %v %v", acl, err)
+	}
+	var acl *accessList
+	if !acl.allowAddr(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}) {
+		t.Fatal("nil access list refused")
+	}
+}
+
+func TestCheckAccessList(t *testing.T) {
+	tests := []struct {
+		addr string
+		err  string
+	}{
+		{"unix:///run/a.sock?allow=10.0.0.0/8", "cidr rule on unix address"},
+		{"tcp://127.0.0.1:80?deny=uid:0", "uid rule only on unix address"},
+		{"udp://127.0.0.1:53?allow=bad", "allow: invalid ip"},
+		{"tcp://127.0.0.1:80?proxy_allow=10.0.0.2", "proxy_allow only on tcp address with proxy_protocol"},
+		{"tcp://127.0.0.1:80?proxy_protocol=v1&proxy_allow=uid:0", "uid rule only on unix address"},
+	}
+	for _, tt := range tests {
+		if _, err := ResolveAddr(tt.addr); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.addr, err, tt.err)
+		}
+	}
+}
+
+func TestAccessListUnixPeerCred(t *testing.T) {
+	if !peerCredSupported {
+		t.Skip("peer credentials not supported")
+	}
+	echo := startEcho(t)
+	dir := t.TempDir()
+
+	tests := []struct {
+		query   string
+		allowed bool
+	}{
+		{fmt.Sprintf("allow=uid:%d", os.Getuid()), true},
+		{fmt.Sprintf("allow=uid:%d", os.Getuid()+1), false},
+		{fmt.Sprintf("allow=gid:%d&deny=pid:%d", os.Getgid(), os.Getpid()), false},
+		{fmt.Sprintf("deny=pid:%d", os.Getpid()+1), true},
+	}
+	for i, tt := range tests {
+		sock := filepath.Join(dir, fmt.Sprintf("%d.sock", i))
+		startTunnel(t, ProxyChainTunnel{
+			Name:    fmt.Sprintf("%s/%d", t.Name(), i),
+			InAddr:  "unix://" + sock + "?" + tt.query,
+			OutAddr: "tcp://" + echo.Addr().String(),
+		})
+
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "hello")
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		conn.Close()
+		if allowed := err == nil && string(buf) == "hello"; allowed != tt.allowed {
+			t.Errorf("%s: allowed %v, want %v (%v)", tt.query, allowed, tt.allowed, err)
+		}
+	}
+}
+
+func TestAccessListProxyAllow(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		proxies string
+		ok      bool
+	}{
+		{"127.0.0.0/8", true},
+		{"10.0.0.2,192.168.0.0/16", false},
+	}
+	for i, tt := range tests {
+		in := freeAddr(t, "tcp")
+		startTunnel(t, ProxyChainTunnel{
+			Name:    fmt.Sprintf("%s/%d", t.Name(), i),
+			InAddr:  "tcp://" + in + "?proxy_protocol=v1&proxy_allow=" + tt.proxies + "&allow=203.0.113.0/24",
+			OutAddr: "tcp://" + echo.Addr().String(),
+		})
+
+		conn, err := net.Dial("tcp", in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// The client in header is allowed, the proxy may not be
+		src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+		writeProxyHeader(conn, "v1", src, conn.RemoteAddr())
+		io.WriteString(conn, "hello")
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		conn.Close()
+		if ok := err == nil && string(buf) == "hello"; ok != tt.ok {
+			t.Errorf("proxy_allow=%s: relayed %v, want %v (%v)", tt.proxies, ok, tt.ok, err)
+		}
+	}
+}
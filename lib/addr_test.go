@@ -1 +1,49 @@
 package lib
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestResolveAddrNoLookup(t *testing.T) {
+	// Hostnames of outbounds are resolved when dialing
+	for _, addr := range []string{
+		"tcp://unresolvable.invalid:80",
+		"udp://unresolvable.invalid:53",
+		"tls://unresolvable.invalid:443",
+		"socks5://unresolvable.invalid:1080",
+		"http-connect://unresolvable.invalid:3128",
+		"mux+tcp6://unresolvable.invalid:9000",
+	} {
+		a, err := ResolveAddr(addr)
+		if err != nil {
+			t.Errorf("%s: %v", addr, err)
+			continue
+		}
+		if a.Host != "unresolvable.invalid"+addr[strings.LastIndexByte(addr, ':'):] {
+			t.Errorf("%s: resolved %+v", addr, a)
+		}
+	}
+
+	for _, addr := range []string{"tcp://no-port.invalid", "udp://[::1", "tcpx://127.0.0.1:80", "tls://127.0.0.1"} {
+		if _, err := ResolveAddr(addr); err == nil {
+			t.Errorf("%s: no error", addr)
+		}
+	}
+}
+
+func TestListenHostname(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(freeAddr(t, "tcp"))
+	startTunnel(t, ProxyChainTunnel{InAddr: "tcp4://localhost:" + port, OutAddr: "tcp://" + echo.Addr().String()})
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := roundTrip(t, conn, "hello"); got != "hello" {
+		t.Fatalf("echo %q", got)
+	}
+}
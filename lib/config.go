@@ -0,0 +1,283 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TunnelConfig a named tunnel in config file
+type TunnelConfig struct {
+	Name string `mapstructure:"name"`
+	In   string `mapstructure:"in"`
+	Out  string `mapstructure:"out"`
+	// Upstreams an upstream group instead of out, selected by Balance:
+	// round-robin (default), least-conn, random or hash
+	Upstreams []string `mapstructure:"upstreams"`
+	Balance   string   `mapstructure:"balance"`
+	// HealthCheck probe backends of upstreams, skip the down ones
+	HealthCheck *HealthCheck `mapstructure:"health_check"`
+	// Mirrors more udp or unix outbounds receiving copies of datagrams, replies only from out
+	Mirrors []string `mapstructure:"mirrors"`
+
+	// UDPTimeout how long to wait a udp response, default 3s
+	UDPTimeout time.Duration `mapstructure:"udp_timeout"`
+	// UDPIdleTimeout close a udp session without datagrams, default 60s
+	UDPIdleTimeout time.Duration `mapstructure:"udp_idle_timeout"`
+	// UDPMaxDatagram max bytes of a udp datagram up to 65535, default 1500
+	UDPMaxDatagram int `mapstructure:"udp_max_datagram"`
+	// StreamIdleTimeout close a stream without data in both directions, default 0 never
+	StreamIdleTimeout time.Duration `mapstructure:"stream_idle_timeout"`
+
+	// Limits max connections of the tunnel and every client ip, and accept rate
+	Limits *ConnLimits `mapstructure:"limits"`
+	// Shaping bytes per second and quotas of the tunnel and every client ip
+	Shaping *Shaping `mapstructure:"shaping"`
+}
+
+// Config all tunnels started in one process, like:
+//
+//	tunnels:
+//	  - name: dns
+//	    in: udp://0.0.0.0:30053
+//	    out: unix:///var/run/dns.socket
+//	    udp_timeout: 5s
+//	    udp_max_datagram: 4096
+//	  - name: quic
+//	    in: udp://0.0.0.0:443
+//	    out: udp://10.0.0.2:443
+//	    udp_idle_timeout: 2m
+//	  - name: syslog
+//	    in: udp://0.0.0.0:514
+//	    out: udp://10.0.0.2:514
+//	    mirrors:
+//	      - udp://10.0.0.3:514
+//	      - unix:///var/run/collector.socket
+//	  - name: web
+//	    in: tcp://0.0.0.0:8080
+//	    out: tcp://10.0.0.2:80
+//	    stream_idle_timeout: 30m
+//	    limits:
+//	      max_conns: 1000
+//	      max_conns_per_ip: 20
+//	      accept_rate: 100
+//	      over_limit: queue
+//	    shaping:
+//	      upload: 1048576
+//	      client_download: 262144
+//	  - name: api
+//	    in: tcp://0.0.0.0:8081
+//	    upstreams:
+//	      - tcp://10.0.0.2:8081?weight=3
+//	      - tcp://10.0.0.3:8081
+//	    balance: least-conn
+//	    health_check:
+//	      interval: 5s
+//	      fall: 3
+//	  - name: proxy
+//	    in: socks5://0.0.0.0:1080
+//	max_conns: 10000
+//	drain_timeout: 30s
+//	ready_addr: 127.0.0.1:8086
+type Config struct {
+	Tunnels []TunnelConfig `mapstructure:"tunnels"`
+	// MaxConns max connections of all tunnels
+	MaxConns int `mapstructure:"max_conns"`
+	// DrainTimeout wait connections to finish on stop before closing them, default 30s
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+	// ReadyAddr serve readiness of tunnels by http on the address, empty not to serve
+	ReadyAddr string `mapstructure:"ready_addr"`
+}
+
+// ConfigError a invalid field of a tunnel
+type ConfigError struct {
+	Tunnel string
+	Field  string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("tunnel %q: field %q: %s", e.Tunnel, e.Field, e.Err)
+}
+
+// Validate check all tunnels, the error names the bad tunnel and field
+func (c *Config) Validate() error {
+	if c.MaxConns < 0 {
+		return errors.New("max_conns should not be negative")
+	}
+	if c.DrainTimeout < 0 {
+		return errors.New("drain_timeout should not be negative")
+	}
+	names := make(map[string]bool, len(c.Tunnels))
+	for i, t := range c.Tunnels {
+		if t.Name == "" {
+			return &ConfigError{Tunnel: fmt.Sprintf("#%d", i), Field: "name", Err: errors.New("is required")}
+		}
+		if names[t.Name] {
+			return &ConfigError{Tunnel: t.Name, Field: "name", Err: errors.New("is duplicated")}
+		}
+		names[t.Name] = true
+
+		if err := t.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate check addresses and options of the tunnel
+func (t *TunnelConfig) Validate() error {
+	if t.In == "" {
+		return &ConfigError{Tunnel: t.Name, Field: "in", Err: errors.New("is required")}
+	}
+	inaddr, err := ResolveAddr(t.In)
+	if err != nil {
+		return &ConfigError{Tunnel: t.Name, Field: "in", Err: err}
+	}
+
+	// An agent dials out to its server, other inbounds listen
+	if err := checkTLSRole(inaddr, !inaddr.IsAgent); err != nil {
+		return &ConfigError{Tunnel: t.Name, Field: "in", Err: err}
+	}
+
+	if len(t.Mirrors) > 0 && !inaddr.IsUDP {
+		return &ConfigError{Tunnel: t.Name, Field: "mirrors", Err: errors.New("only for udp inbound")}
+	}
+	for _, mirror := range t.Mirrors {
+		mirroraddr, err := ResolveAddr(mirror)
+		if err != nil {
+			return &ConfigError{Tunnel: t.Name, Field: "mirrors", Err: err}
+		}
+		if !isMirrorAddr(mirroraddr) {
+			return &ConfigError{Tunnel: t.Name, Field: "mirrors", Err: errors.New("should be a udp or unix address: " + mirror)}
+		}
+		if hasAccessList(mirroraddr) {
+			return &ConfigError{Tunnel: t.Name, Field: "mirrors", Err: errors.New("allow, deny and proxy_allow are only on inbound")}
+		}
+	}
+
+	if inaddr.IsDynamic() {
+		if t.Out != "" {
+			return &ConfigError{Tunnel: t.Name, Field: "out", Err: errors.New("should be empty, destination comes from client")}
+		}
+		if len(t.Upstreams) > 0 {
+			return &ConfigError{Tunnel: t.Name, Field: "upstreams", Err: errors.New("should be empty, destination comes from client")}
+		}
+		return t.validateOptions()
+	}
+
+	var outaddr *ProxyProtoAddr
+	if len(t.Upstreams) > 0 {
+		if t.Out != "" {
+			return &ConfigError{Tunnel: t.Name, Field: "out", Err: errors.New("should be empty with upstreams")}
+		}
+		if outaddr, err = NewGroupAddr(t.Upstreams, t.Balance); err != nil {
+			return &ConfigError{Tunnel: t.Name, Field: "upstreams", Err: err}
+		}
+	} else {
+		if t.Out == "" {
+			return &ConfigError{Tunnel: t.Name, Field: "out", Err: errors.New("is required")}
+		}
+		if outaddr, err = ResolveAddr(t.Out); err != nil {
+			return &ConfigError{Tunnel: t.Name, Field: "out", Err: err}
+		}
+		if t.Balance != "" {
+			return &ConfigError{Tunnel: t.Name, Field: "balance", Err: errors.New("only for upstreams")}
+		}
+		if t.HealthCheck != nil {
+			return &ConfigError{Tunnel: t.Name, Field: "health_check", Err: errors.New("only for upstreams")}
+		}
+	}
+
+	// A reverse outbound listens for agents, other outbounds dial
+	for _, a := range append([]*ProxyProtoAddr{outaddr}, outaddr.Group...) {
+		if err := checkTLSRole(a, a.IsReverse); err != nil {
+			return &ConfigError{Tunnel: t.Name, Field: "out", Err: err}
+		}
+		if hasAccessList(a) {
+			return &ConfigError{Tunnel: t.Name, Field: "out", Err: errors.New("allow, deny and proxy_allow are only on inbound")}
+		}
+	}
+
+	if t.HealthCheck != nil {
+		if err := t.HealthCheck.Validate(); err != nil {
+			return &ConfigError{Tunnel: t.Name, Field: "health_check", Err: err}
+		}
+		if outaddr.IsUDP && t.HealthCheck.Send == "" {
+			return &ConfigError{Tunnel: t.Name, Field: "health_check", Err: errors.New("udp backends need send")}
+		}
+	}
+
+	if inaddr.IsReverse {
+		return &ConfigError{Tunnel: t.Name, Field: "in", Err: errors.New("reverse address is only outbound")}
+	}
+	if inaddr.SRV != "" {
+		return &ConfigError{Tunnel: t.Name, Field: "in", Err: errors.New("srv address is only outbound")}
+	}
+	if outaddr.IsAgent {
+		return &ConfigError{Tunnel: t.Name, Field: "out", Err: errors.New("agent address is only inbound")}
+	}
+	if inaddr.IsAgent && inaddr.Options.Get("name") == "" {
+		return &ConfigError{Tunnel: t.Name, Field: "in", Err: errors.New("agent address needs a name")}
+	}
+	for _, a := range append([]*ProxyProtoAddr{outaddr}, outaddr.Group...) {
+		if a.IsReverse && a.Options.Get("name") == "" {
+			return &ConfigError{Tunnel: t.Name, Field: "out", Err: errors.New("reverse address needs a name")}
+		}
+	}
+
+	if inaddr.IsUDP && inaddr.Options.Get("framing") != "" {
+		return &ConfigError{Tunnel: t.Name, Field: "in", Err: errors.New("framing is only on stream inbound")}
+	}
+	if !inaddr.IsUDP && outaddr.IsUDP && inaddr.Options.Get("framing") == "" {
+		return &ConfigError{Tunnel: t.Name, Field: "out", Err: errors.New("not support a tunnel from stream to udp protocol without framing")}
+	}
+
+	return t.validateOptions()
+}
+
+// validateOptions check options of the tunnel
+func (t *TunnelConfig) validateOptions() error {
+	if t.UDPTimeout < 0 {
+		return &ConfigError{Tunnel: t.Name, Field: "udp_timeout", Err: errors.New("should not be negative")}
+	}
+	if t.UDPIdleTimeout < 0 {
+		return &ConfigError{Tunnel: t.Name, Field: "udp_idle_timeout", Err: errors.New("should not be negative")}
+	}
+	if t.StreamIdleTimeout < 0 {
+		return &ConfigError{Tunnel: t.Name, Field: "stream_idle_timeout", Err: errors.New("should not be negative")}
+	}
+	if t.UDPMaxDatagram < 0 || t.UDPMaxDatagram > maxDatagram {
+		return &ConfigError{Tunnel: t.Name, Field: "udp_max_datagram", Err: fmt.Errorf("should be between 0 and %d", maxDatagram)}
+	}
+	if t.Limits != nil {
+		if err := t.Limits.Validate(); err != nil {
+			return &ConfigError{Tunnel: t.Name, Field: "limits", Err: err}
+		}
+	}
+	if t.Shaping != nil {
+		if err := t.Shaping.Validate(); err != nil {
+			return &ConfigError{Tunnel: t.Name, Field: "shaping", Err: err}
+		}
+	}
+	return nil
+}
+
+// Tunnel create a ProxyChainTunnel from config
+func (t *TunnelConfig) Tunnel() ProxyChainTunnel {
+	return ProxyChainTunnel{
+		Name:              t.Name,
+		InAddr:            t.In,
+		OutAddr:           t.Out,
+		Upstreams:         t.Upstreams,
+		Balance:           t.Balance,
+		HealthCheck:       t.HealthCheck,
+		MirrorAddrs:       t.Mirrors,
+		UDPTimeout:        t.UDPTimeout,
+		UDPIdleTimeout:    t.UDPIdleTimeout,
+		UDPMaxDatagram:    t.UDPMaxDatagram,
+		Limits:            t.Limits,
+		Shaping:           t.Shaping,
+		StreamIdleTimeout: t.StreamIdleTimeout,
+	}
+}
@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		tunnels []TunnelConfig
+		tunnel  string
+		field   string
+	}{
+		{"missing outbound", []TunnelConfig{{Name: "web", In: "tcp://127.0.0.1:8080"}}, "web", "out"},
+		{"missing inbound", []TunnelConfig{{Name: "web", Out: "tcp://127.0.0.1:80"}}, "web", "in"},
+		{"bad inbound scheme", []TunnelConfig{{Name: "web", In: "sctp://127.0.0.1:8080", Out: "tcp://127.0.0.1:80"}}, "web", "in"},
+		{"bad outbound scheme", []TunnelConfig{{Name: "web", In: "tcp://127.0.0.1:8080", Out: "ftp://127.0.0.1:21"}}, "web", "out"},
+		{"bad duration", []TunnelConfig{{Name: "dns", In: "udp://127.0.0.1:53", Out: "udp://127.0.0.1:5353", UDPTimeout: -time.Second}}, "dns", "udp_timeout"},
+		{"bad idle duration", []TunnelConfig{{Name: "web", In: "tcp://127.0.0.1:8080", Out: "tcp://127.0.0.1:80", StreamIdleTimeout: -time.Minute}}, "web", "stream_idle_timeout"},
+		{"duplicate names", []TunnelConfig{
+			{Name: "web", In: "tcp://127.0.0.1:8080", Out: "tcp://127.0.0.1:80"},
+			{Name: "web", In: "tcp://127.0.0.1:8081", Out: "tcp://127.0.0.1:81"},
+		}, "web", "name"},
+		{"missing name", []TunnelConfig{
+			{Name: "web", In: "tcp://127.0.0.1:8080", Out: "tcp://127.0.0.1:80"},
+			{In: "tcp://127.0.0.1:8081", Out: "tcp://127.0.0.1:81"},
+		}, "#1", "name"},
+		{"outbound of dynamic inbound", []TunnelConfig{{Name: "proxy", In: "socks5://127.0.0.1:1080", Out: "tcp://127.0.0.1:80"}}, "proxy", "out"},
+		{"balance without upstreams", []TunnelConfig{{Name: "web", In: "tcp://127.0.0.1:8080", Out: "tcp://127.0.0.1:80", Balance: "random"}}, "web", "balance"},
+		{"stream to udp without framing", []TunnelConfig{{Name: "dns", In: "tcp://127.0.0.1:53", Out: "udp://127.0.0.1:5353"}}, "dns", "out"},
+		{"acl on outbound", []TunnelConfig{{Name: "web", In: "tcp://127.0.0.1:8080", Out: "tcp://127.0.0.1:80?allow=10.0.0.0/8"}}, "web", "out"},
+		{"acl on upstream", []TunnelConfig{{Name: "web", In: "tcp://127.0.0.1:8080", Upstreams: []string{"tcp://127.0.0.1:80", "tcp://127.0.0.1:81?deny=10.0.0.1"}}}, "web", "out"},
+		{"acl on mirror", []TunnelConfig{{Name: "dns", In: "udp://127.0.0.1:53", Out: "udp://127.0.0.1:5353", Mirrors: []string{"udp://127.0.0.1:5354?allow=127.0.0.1"}}}, "dns", "mirrors"},
+		{"bad limits", []TunnelConfig{{Name: "web", In: "tcp://127.0.0.1:8080", Out: "tcp://127.0.0.1:80", Limits: &ConnLimits{MaxConns: -1}}}, "web", "limits"},
+	}
+	for _, tt := range tests {
+		c := &Config{Tunnels: tt.tunnels}
+		err := c.Validate()
+		var ce *ConfigError
+		if !errors.As(err, &ce) {
+			t.Errorf("%s: error %v, want a ConfigError", tt.name, err)
+			continue
+		}
+		if ce.Tunnel != tt.tunnel || ce.Field != tt.field {
+			t.Errorf("%s: tunnel %q field %q, want %q %q", tt.name, ce.Tunnel, ce.Field, tt.tunnel, tt.field)
+		}
+		if msg := err.Error(); !strings.Contains(msg, `tunnel "`+tt.tunnel+`"`) || !strings.Contains(msg, `field "`+tt.field+`"`) {
+			t.Errorf("%s: message %q does not name the tunnel and field", tt.name, msg)
+		}
+	}
+
+	valid := &Config{Tunnels: []TunnelConfig{
+		{Name: "web", In: "tcp://127.0.0.1:8080", Out: "tcp://127.0.0.1:80", StreamIdleTimeout: time.Minute},
+		{Name: "proxy", In: "socks5://127.0.0.1:1080"},
+		{Name: "api", In: "tcp://127.0.0.1:8081", Upstreams: []string{"tcp://127.0.0.1:81", "tcp://127.0.0.1:82"}, Balance: "least-conn"},
+	}}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Config{DrainTimeout: -time.Second}).Validate(); err == nil {
+		t.Fatal("negative drain_timeout accepted")
+	}
+}
@@ -0,0 +1,276 @@
+package lib
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Connection limits of a tunnel, like:
+//
+//	limits:
+//	  max_conns: 1000
+//	  max_conns_per_ip: 20
+//	  accept_rate: 100
+//	  over_limit: queue
+//	  queue_timeout: 5s
+//	  max_queue: 1000
+//
+// max_conns counts connections of the tunnel, max_conns_per_ip connections of every client ip,
+// accept_rate new connections per second. Over a limit, a new connection is closed at once
+// (over_limit: reject, the default), or waits until under limits in queue_timeout (default 5s),
+// at most max_queue (default 1000) connections wait, more are closed at once.
+// A new udp session is limited too, but its datagram is dropped at once, never queued.
+// max_conns at top of config limits connections of all tunnels. Over max_conns, a client
+// of socks5, http-connect or PROXY protocol is closed before negotiating if it can not wait.
+
+// Over limit behaviors
+const (
+	OverLimitReject = "reject"
+	OverLimitQueue  = "queue"
+)
+
+const (
+	defaultQueueTimeout = 5 * time.Second
+	defaultMaxQueue     = 1000
+)
+
+// ConnLimits limits of connections of a tunnel, zero is unlimited
+type ConnLimits struct {
+	MaxConns      int           `mapstructure:"max_conns"`
+	MaxConnsPerIP int           `mapstructure:"max_conns_per_ip"`
+	AcceptRate    float64       `mapstructure:"accept_rate"`
+	OverLimit     string        `mapstructure:"over_limit"`
+	QueueTimeout  time.Duration `mapstructure:"queue_timeout"`
+	MaxQueue      int           `mapstructure:"max_queue"`
+}
+
+// Validate check the limits
+func (l *ConnLimits) Validate() error {
+	if l.MaxConns < 0 || l.MaxConnsPerIP < 0 || l.AcceptRate < 0 || l.QueueTimeout < 0 || l.MaxQueue < 0 {
+		return errors.New("should not be negative")
+	}
+	switch l.OverLimit {
+	case "", OverLimitReject, OverLimitQueue:
+		return nil
+	}
+	return errors.New("over_limit should be reject or queue: " + l.OverLimit)
+}
+
+// limits the connections of all tunnels, all limiters count under its lock
+var limits = struct {
+	mu       sync.Mutex
+	maxConns int
+	conns    int
+	// wake closed and replaced when a connection is released at max_conns of all tunnels
+	wake chan struct{}
+}{wake: make(chan struct{})}
+
+// SetMaxConns limit the connections of all tunnels, zero is unlimited
+func SetMaxConns(n int) {
+	limits.mu.Lock()
+	limits.maxConns = n
+	limits.mu.Unlock()
+}
+
+// connLimiter count connections of a tunnel
+type connLimiter struct {
+	limits ConnLimits
+
+	conns int
+	perIP map[string]int
+	// tokens of accept rate, refilled since last
+	tokens float64
+	last   time.Time
+	// waiting connections in queue, wake closed and replaced when a connection is released
+	waiting int
+	wake    chan struct{}
+
+	active   *Gauge
+	queued   *Counter
+	rejected *Counter
+	// reasons rejected counters of every limit
+	reasons map[string]*Counter
+}
+
+// newConnLimiter the limiter of tunnel, also counts the connections of all tunnels
+func newConnLimiter(tunnel string, l *ConnLimits) *connLimiter {
+	cl := &connLimiter{
+		perIP:    make(map[string]int),
+		wake:     make(chan struct{}),
+		active:   GetGauge(tunnel + ".conns"),
+		queued:   GetCounter(tunnel + ".conn_queued"),
+		rejected: GetCounter(tunnel + ".conn_rejected"),
+		reasons:  make(map[string]*Counter),
+	}
+	for _, reason := range []string{"global_max_conns", "max_conns", "max_conns_per_ip", "accept_rate", "max_queue"} {
+		cl.reasons[reason] = GetCounter(tunnel + ".rejected_" + reason)
+	}
+	if l != nil {
+		cl.limits = *l
+	}
+	if cl.limits.QueueTimeout == 0 {
+		cl.limits.QueueTimeout = defaultQueueTimeout
+	}
+	if cl.limits.MaxQueue == 0 {
+		cl.limits.MaxQueue = defaultMaxQueue
+	}
+	cl.tokens = math.Max(cl.limits.AcceptRate, 1)
+	cl.last = time.Now()
+	return cl
+}
+
+// acquire count a connection of client, wait if queued and allowed, release it when closed
+func (cl *connLimiter) acquire(client net.Addr, queue bool) (func(), error) {
+	if cl == nil {
+		return func() {}, nil
+	}
+	ip := limitKey(client)
+	queue = queue && cl.limits.OverLimit == OverLimitQueue
+	deadline := time.Now().Add(cl.limits.QueueTimeout)
+	waiting := false
+
+	for {
+		limits.mu.Lock()
+		reason, retry := cl.check(ip)
+		if reason == "" {
+			limits.conns++
+			cl.conns++
+			if ip != "" {
+				cl.perIP[ip]++
+			}
+			if cl.limits.AcceptRate > 0 {
+				cl.tokens--
+			}
+			if waiting {
+				cl.waiting--
+			}
+			cl.active.Add(1)
+			limits.mu.Unlock()
+			return cl.releaser(ip), nil
+		}
+		if queue && !waiting && cl.waiting >= cl.limits.MaxQueue {
+			reason, queue = "max_queue", false
+		}
+		wait := time.Until(deadline)
+		if !queue || wait <= 0 {
+			if waiting {
+				cl.waiting--
+			}
+			limits.mu.Unlock()
+			cl.reasons[reason].Add(1)
+			cl.rejected.Add(1)
+			return nil, errors.New("over " + reason)
+		}
+		if !waiting {
+			waiting = true
+			cl.waiting++
+			cl.queued.Add(1)
+		}
+		// Only a release of all tunnels helps over global_max_conns
+		wake := cl.wake
+		if reason == "global_max_conns" {
+			wake = limits.wake
+		}
+		limits.mu.Unlock()
+
+		if retry > 0 && retry < wait {
+			wait = retry
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// acceptable check a new connection before negotiating with it, an error if the tunnel
+// or all tunnels are at max_conns and it can not wait in queue
+func (cl *connLimiter) acceptable() error {
+	if cl == nil {
+		return nil
+	}
+	limits.mu.Lock()
+	reason := ""
+	if limits.maxConns > 0 && limits.conns >= limits.maxConns {
+		reason = "global_max_conns"
+	} else if cl.limits.MaxConns > 0 && cl.conns >= cl.limits.MaxConns {
+		reason = "max_conns"
+	}
+	if reason != "" && cl.limits.OverLimit == OverLimitQueue && cl.waiting < cl.limits.MaxQueue {
+		reason = ""
+	}
+	limits.mu.Unlock()
+
+	if reason == "" {
+		return nil
+	}
+	cl.reasons[reason].Add(1)
+	cl.rejected.Add(1)
+	return errors.New("over " + reason)
+}
+
+// check the limit exceeded, and when to retry for accept rate, under lock
+func (cl *connLimiter) check(ip string) (string, time.Duration) {
+	if limits.maxConns > 0 && limits.conns >= limits.maxConns {
+		return "global_max_conns", 0
+	}
+	if cl.limits.MaxConns > 0 && cl.conns >= cl.limits.MaxConns {
+		return "max_conns", 0
+	}
+	if ip != "" && cl.limits.MaxConnsPerIP > 0 && cl.perIP[ip] >= cl.limits.MaxConnsPerIP {
+		return "max_conns_per_ip", 0
+	}
+	if rate := cl.limits.AcceptRate; rate > 0 {
+		// Token bucket, burst of one second
+		now := time.Now()
+		cl.tokens = math.Min(math.Max(rate, 1), cl.tokens+now.Sub(cl.last).Seconds()*rate)
+		cl.last = now
+		if cl.tokens < 1 {
+			return "accept_rate", time.Duration((1 - cl.tokens) / rate * float64(time.Second))
+		}
+	}
+	return "", 0
+}
+
+// releaser release the connection once
+func (cl *connLimiter) releaser(ip string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limits.mu.Lock()
+			if limits.maxConns > 0 && limits.conns >= limits.maxConns {
+				close(limits.wake)
+				limits.wake = make(chan struct{})
+			}
+			limits.conns--
+			cl.conns--
+			if ip != "" {
+				if cl.perIP[ip]--; cl.perIP[ip] <= 0 {
+					delete(cl.perIP, ip)
+				}
+			}
+			cl.active.Add(-1)
+			if cl.waiting > 0 {
+				close(cl.wake)
+				cl.wake = make(chan struct{})
+			}
+			limits.mu.Unlock()
+		})
+	}
+}
+
+// limitKey the ip of tcp or udp client, empty for others not limited by ip
+func limitKey(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	return ""
+}
@@ -0,0 +1,273 @@
+package lib
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClient a tcp client address of ip
+func testClient(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestConnLimitsValidate(t *testing.T) {
+	tests := []struct {
+		limits ConnLimits
+		err    string
+	}{
+		{ConnLimits{MaxConns: 10, OverLimit: OverLimitQueue}, ""},
+		{ConnLimits{MaxConns: -1}, "negative"},
+		{ConnLimits{MaxQueue: -1}, "negative"},
+		{ConnLimits{QueueTimeout: -time.Second}, "negative"},
+		{ConnLimits{OverLimit: "drop"}, "over_limit should be reject or queue"},
+	}
+	for _, tt := range tests {
+		err := tt.limits.Validate()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%+v: error %v, want %q", tt.limits, err, tt.err)
+		}
+	}
+}
+
+func TestConnLimiterNil(t *testing.T) {
+	var cl *connLimiter
+	release, err := cl.acquire(testClient("10.0.0.1"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if err := cl.acceptable(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnLimiterReject(t *testing.T) {
+	cl := newConnLimiter(t.Name(), &ConnLimits{MaxConns: 3, MaxConnsPerIP: 2})
+
+	var releases []func()
+	for _, ip := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"} {
+		release, err := cl.acquire(testClient(ip), true)
+		if err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := cl.acquire(testClient("10.0.0.3"), true); err == nil || err.Error() != "over max_conns" {
+		t.Fatalf("error %v, want over max_conns", err)
+	}
+	if err := cl.acceptable(); err == nil {
+		t.Fatal("acceptable over max_conns")
+	}
+
+	// Released twice counts once
+	releases[2]()
+	releases[2]()
+	if _, err := cl.acquire(testClient("10.0.0.1"), true); err == nil || err.Error() != "over max_conns_per_ip" {
+		t.Fatalf("error %v, want over max_conns_per_ip", err)
+	}
+	if release, err := cl.acquire(testClient("10.0.0.3"), true); err != nil {
+		t.Fatal(err)
+	} else {
+		release()
+	}
+	if cl.active.Value() != 2 || cl.rejected.Value() != 3 || cl.reasons["max_conns"].Value() != 2 {
+		t.Fatalf("active %d, rejected %d", cl.active.Value(), cl.rejected.Value())
+	}
+	for _, release := range releases[:2] {
+		release()
+	}
+	if len(cl.perIP) != 0 || cl.conns != 0 {
+		t.Fatalf("counts left %d %v", cl.conns, cl.perIP)
+	}
+}
+
+func TestConnLimiterAcceptRate(t *testing.T) {
+	cl := newConnLimiter(t.Name(), &ConnLimits{AcceptRate: 2})
+	for i := 0; i < 2; i++ {
+		release, err := cl.acquire(testClient("10.0.0.1"), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if _, err := cl.acquire(testClient("10.0.0.1"), true); err == nil || err.Error() != "over accept_rate" {
+		t.Fatalf("error %v, want over accept_rate", err)
+	}
+
+	// Queued until the next token
+	cl = newConnLimiter(t.Name()+"/queue", &ConnLimits{AcceptRate: 10, OverLimit: OverLimitQueue})
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		release, err := cl.acquire(testClient("10.0.0.1"), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("11 connections accepted in %s", d)
+	}
+}
+
+func TestConnLimiterQueue(t *testing.T) {
+	cl := newConnLimiter(t.Name(), &ConnLimits{MaxConns: 1, OverLimit: OverLimitQueue, QueueTimeout: 5 * time.Second, MaxQueue: 1})
+	release, err := cl.acquire(testClient("10.0.0.1"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		release, err := cl.acquire(testClient("10.0.0.2"), true)
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	for {
+		limits.mu.Lock()
+		waiting := cl.waiting
+		limits.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, rejected at once
+	if _, err := cl.acquire(testClient("10.0.0.3"), true); err == nil || err.Error() != "over max_queue" {
+		t.Fatalf("error %v, want over max_queue", err)
+	}
+	if err := cl.acceptable(); err == nil {
+		t.Fatal("acceptable with a full queue")
+	}
+	// A udp session never waits
+	if _, err := cl.acquire(testClient("10.0.0.3"), false); err == nil || err.Error() != "over max_conns" {
+		t.Fatalf("error %v, want over max_conns", err)
+	}
+
+	release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("queued connection not woken by release")
+	}
+	if cl.waiting != 0 || cl.queued.Value() != 1 {
+		t.Fatalf("%d waiting, %d queued", cl.waiting, cl.queued.Value())
+	}
+
+	// Timeout in queue
+	cl = newConnLimiter(t.Name()+"/timeout", &ConnLimits{MaxConns: 1, OverLimit: OverLimitQueue, QueueTimeout: 50 * time.Millisecond})
+	release, _ = cl.acquire(testClient("10.0.0.1"), true)
+	defer release()
+	if _, err := cl.acquire(testClient("10.0.0.2"), true); err == nil || err.Error() != "over max_conns" {
+		t.Fatalf("error %v, want over max_conns", err)
+	}
+	if cl.waiting != 0 {
+		t.Fatalf("%d waiting after timeout", cl.waiting)
+	}
+}
+
+func TestConnLimiterWakeOwnTunnel(t *testing.T) {
+	a := newConnLimiter(t.Name()+"/a", &ConnLimits{MaxConns: 1})
+	b := newConnLimiter(t.Name()+"/b", &ConnLimits{MaxConns: 1})
+	releaseA, _ := a.acquire(testClient("10.0.0.1"), true)
+	releaseB, _ := b.acquire(testClient("10.0.0.1"), true)
+	defer releaseB()
+
+	// Waiters of b are not woken by a release of a
+	limits.mu.Lock()
+	a.waiting, b.waiting = 1, 1
+	wakeA, wakeB := a.wake, b.wake
+	limits.mu.Unlock()
+	releaseA()
+
+	limits.mu.Lock()
+	a.waiting, b.waiting = 0, 0
+	limits.mu.Unlock()
+	select {
+	case <-wakeA:
+	default:
+		t.Fatal("waiters of a not woken")
+	}
+	select {
+	case <-wakeB:
+		t.Fatal("waiters of b woken by a release of a")
+	default:
+	}
+}
+
+func TestConnLimiterGlobal(t *testing.T) {
+	limits.mu.Lock()
+	conns := limits.conns
+	limits.mu.Unlock()
+	SetMaxConns(conns + 1)
+	defer SetMaxConns(0)
+
+	a := newConnLimiter(t.Name()+"/a", &ConnLimits{OverLimit: OverLimitQueue, QueueTimeout: 5 * time.Second})
+	b := newConnLimiter(t.Name()+"/b", &ConnLimits{OverLimit: OverLimitQueue, QueueTimeout: 5 * time.Second})
+	release, err := a.acquire(testClient("10.0.0.1"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.acquire(testClient("10.0.0.1"), false); err == nil || err.Error() != "over global_max_conns" {
+		t.Fatalf("error %v, want over global_max_conns", err)
+	}
+
+	// A release of a wakes the waiter of b over global_max_conns
+	acquired := make(chan error, 1)
+	go func() {
+		release, err := b.acquire(testClient("10.0.0.2"), true)
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiter of b not woken by release of a")
+	}
+}
+
+func TestConnLimitBeforeNegotiate(t *testing.T) {
+	echo := startEcho(t)
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{InAddr: "socks5://" + in, Limits: &ConnLimits{MaxConns: 1}})
+
+	first, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := socks5Connect(first, echo.Addr().String(), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, first, "hello")
+
+	// Closed before the socks5 greeting is read
+	second, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := second.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("read %d %v, want closed", n, err)
+	}
+	if n := GetCounter(t.Name() + ".rejected_max_conns").Value(); n != 1 {
+		t.Fatalf("%d rejections counted", n)
+	}
+}
@@ -0,0 +1,269 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Idle pool keep connections dialed ahead to a stream outbound, like:
+//
+//	tcp://10.0.0.2:80?pool_min_idle=4&pool_max_idle=16&pool_max_age=30s
+//
+// A client takes an idle connection instead of connecting (and tls handshake).
+// The pool is filled up to pool_min_idle, and more by the connections taken recently,
+// but at most pool_max_idle (default pool_min_idle). An idle connection older
+// than pool_max_age (default 30s), or closed by upstream, is dropped.
+
+const (
+	defaultPoolMaxAge = 30 * time.Second
+	poolFillInterval  = time.Second
+	// poolCheckTimeout how long to check an idle connection is not closed by upstream
+	poolCheckTimeout = time.Millisecond
+)
+
+// poolOptions sizes of idle pool, minIdle is zero if not pooled
+type poolOptions struct {
+	minIdle int
+	maxIdle int
+	maxAge  time.Duration
+}
+
+// parsePoolOptions parse pool options of address
+func parsePoolOptions(options url.Values) (*poolOptions, error) {
+	o := &poolOptions{maxAge: defaultPoolMaxAge}
+	for key, n := range map[string]*int{"pool_min_idle": &o.minIdle, "pool_max_idle": &o.maxIdle} {
+		if v := options.Get(key); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				return nil, errors.New(key + " should be a non-negative integer: " + v)
+			}
+			*n = i
+		}
+	}
+	if v := options.Get("pool_max_age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, errors.New("pool_max_age should be a positive duration: " + v)
+		}
+		o.maxAge = d
+	}
+	if o.maxIdle == 0 {
+		o.maxIdle = o.minIdle
+	}
+	if o.maxIdle < o.minIdle {
+		return nil, errors.New("pool_max_idle should not be less than pool_min_idle")
+	}
+	return o, nil
+}
+
+// idleConn a connection in pool
+type idleConn struct {
+	net.Conn
+	dialedAt time.Time
+}
+
+// ProxyTunnelPoolDialer keep idle connections of a stream dialer
+type ProxyTunnelPoolDialer struct {
+	ProxyTunnelDialer
+	options *poolOptions
+
+	mu   sync.Mutex
+	idle []idleConn
+	// taken connections since last fill
+	taken int
+	// hits and misses of taking a connection
+	hits   *Counter
+	misses *Counter
+
+	// done closed to stop filling
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newPoolDialer pool the connections of dialer, nil if not pooled
+func newPoolDialer(dialer ProxyTunnelDialer, addr *ProxyProtoAddr) *ProxyTunnelPoolDialer {
+	if dialer.SupportMultiplex() || dialer.IsConnectionless() {
+		return nil
+	}
+	options, err := parsePoolOptions(addr.Options)
+	if err != nil || options.maxIdle == 0 {
+		return nil
+	}
+	p := &ProxyTunnelPoolDialer{
+		ProxyTunnelDialer: dialer,
+		options:           options,
+		hits:              GetCounter(addr.Addr + ".pool_hits"),
+		misses:            GetCounter(addr.Addr + ".pool_misses"),
+		done:              make(chan struct{}),
+	}
+	go p.keepFilled(addr.Addr)
+	return p
+}
+
+// GetConn take an idle connection, or connect if none
+func (p *ProxyTunnelPoolDialer) GetConn() (net.Conn, error) {
+	return p.GetConnFor(context.Background(), nil)
+}
+
+// GetConnFor take an idle connection, or connect until ctx is done if none
+func (p *ProxyTunnelPoolDialer) GetConnFor(ctx context.Context, client net.Addr) (net.Conn, error) {
+	p.mu.Lock()
+	p.taken++
+	p.mu.Unlock()
+
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			p.misses.Add(1)
+			return dialFor(ctx, p.ProxyTunnelDialer, client)
+		}
+		// The newest one is least likely closed by upstream
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if time.Since(c.dialedAt) < p.options.maxAge {
+			if conn := checkIdleConn(c.Conn); conn != nil {
+				p.hits.Add(1)
+				return conn, nil
+			}
+		}
+		c.Close()
+	}
+}
+
+// keepFilled drop old connections and fill the pool every interval
+func (p *ProxyTunnelPoolDialer) keepFilled(addr string) {
+	failed := false
+	for {
+		p.mu.Lock()
+		fresh := p.idle[:0]
+		for _, c := range p.idle {
+			if time.Since(c.dialedAt) < p.options.maxAge {
+				fresh = append(fresh, c)
+			} else {
+				c.Close()
+			}
+		}
+		p.idle = fresh
+		// Keep more for the load of last interval
+		target := p.options.minIdle + p.taken
+		if target > p.options.maxIdle {
+			target = p.options.maxIdle
+		}
+		p.taken = 0
+		need := target - len(p.idle)
+		p.mu.Unlock()
+
+		for i := 0; i < need; i++ {
+			conn, err := p.ProxyTunnelDialer.GetConn()
+			if err != nil {
+				if !failed {
+					log.Warnf("fill idle pool of %s failed: %s", addr, err)
+				}
+				failed = true
+				break
+			}
+			if failed {
+				log.Infof("fill idle pool of %s again", addr)
+			}
+			failed = false
+			p.mu.Lock()
+			if p.closed() {
+				p.mu.Unlock()
+				conn.Close()
+				return
+			}
+			p.idle = append(p.idle, idleConn{Conn: conn, dialedAt: time.Now()})
+			p.mu.Unlock()
+		}
+
+		select {
+		case <-p.done:
+			return
+		case <-time.After(poolFillInterval):
+		}
+	}
+}
+
+// closed the pool is closed
+func (p *ProxyTunnelPoolDialer) closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stop filling and close the idle connections
+func (p *ProxyTunnelPoolDialer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.idle = nil
+	return nil
+}
+
+// checkIdleConn check the connection is not closed by upstream, the data sent by
+// upstream meanwhile is kept for the client
+func checkIdleConn(conn net.Conn) net.Conn {
+	buf := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(poolCheckTimeout))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		return &replayConn{Conn: conn, b: buf[:n]}
+	}
+	if opErr, ok := err.(net.Error); ok && opErr.Timeout() {
+		return conn
+	}
+	return nil
+}
+
+// replayConn read the bytes read ahead first
+type replayConn struct {
+	net.Conn
+	b []byte
+}
+
+// CloseWrite half-close the connection under
+func (c *replayConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.b) > 0 {
+		n := copy(b, c.b)
+		c.b = c.b[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// dialerKey the same addresses share a dialer, with the options, proxies and backends
+func dialerKey(addr *ProxyProtoAddr) string {
+	key := addr.Addr + "?" + addr.Options.Encode()
+	for _, hop := range addr.Via {
+		key = dialerKey(hop) + "/" + key
+	}
+	if len(addr.Group) > 0 {
+		key = addr.Balance + "("
+		for _, member := range addr.Group {
+			key += dialerKey(member) + ","
+		}
+		key += ")"
+	}
+	return key
+}
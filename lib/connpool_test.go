@@ -0,0 +1,200 @@
+package lib
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestPool a pool dialer of address, closed when the test ends
+func newTestPool(t *testing.T, address string) *ProxyTunnelPoolDialer {
+	t.Helper()
+	a, err := ResolveAddr(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPoolDialer(newDailer(a), a)
+	if p == nil {
+		t.Fatalf("%s not pooled", address)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// waitIdle wait the pool is filled with n idle connections
+func waitIdle(t *testing.T, p *ProxyTunnelPoolDialer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		idle := len(p.idle)
+		p.mu.Unlock()
+		if idle >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d idle connections, want %d", idle, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolDialerHitMiss(t *testing.T) {
+	echo := startEcho(t)
+	p := newTestPool(t, "tcp://"+echo.Addr().String()+"?pool_min_idle=2")
+	hits, misses := p.hits.Value(), p.misses.Value()
+	waitIdle(t, p, 2)
+
+	for i := 0; i < 3; i++ {
+		conn, err := p.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := roundTrip(t, conn, "hello"); got != "hello" {
+			t.Fatalf("echo %q", got)
+		}
+		conn.Close()
+	}
+	if h, m := p.hits.Value()-hits, p.misses.Value()-misses; h != 2 || m != 1 {
+		t.Fatalf("%d hits %d misses, want 2 and 1", h, m)
+	}
+}
+
+func TestPoolDialerMaxAge(t *testing.T) {
+	echo := startEcho(t)
+	p := newTestPool(t, "tcp://"+echo.Addr().String()+"?pool_min_idle=1&pool_max_age=50ms")
+	hits, misses := p.hits.Value(), p.misses.Value()
+	waitIdle(t, p, 1)
+
+	// The idle connection is too old to be taken before the next fill
+	time.Sleep(100 * time.Millisecond)
+	conn, err := p.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if h, m := p.hits.Value()-hits, p.misses.Value()-misses; h != 0 || m != 1 {
+		t.Fatalf("%d hits %d misses, want 0 and 1", h, m)
+	}
+}
+
+func TestPoolDialerClosedByUpstream(t *testing.T) {
+	// The upstream closes every connection at once
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	p := newTestPool(t, "tcp://"+l.Addr().String()+"?pool_min_idle=2")
+	hits, misses := p.hits.Value(), p.misses.Value()
+	waitIdle(t, p, 2)
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := p.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if h, m := p.hits.Value()-hits, p.misses.Value()-misses; h != 0 || m != 1 {
+		t.Fatalf("%d hits %d misses, want 0 and 1", h, m)
+	}
+	p.mu.Lock()
+	idle := len(p.idle)
+	p.mu.Unlock()
+	if idle != 0 {
+		t.Fatalf("%d closed connections kept", idle)
+	}
+}
+
+func TestCheckIdleConn(t *testing.T) {
+	client, server := tcpPair(t)
+	if conn := checkIdleConn(client); conn != client {
+		t.Fatalf("idle connection %v, want it as it is", conn)
+	}
+
+	// Data of upstream meanwhile is read first
+	server.Write([]byte("hi"))
+	time.Sleep(20 * time.Millisecond)
+	conn := checkIdleConn(client)
+	if _, ok := conn.(*replayConn); !ok {
+		t.Fatalf("idle connection %T, want a replay one", conn)
+	}
+	buf := make([]byte, 2)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _ := conn.Read(buf[:1]); n != 1 || buf[0] != 'h' {
+		t.Fatalf("read %q first", buf[:n])
+	}
+	if n, _ := conn.Read(buf[:1]); n != 1 || buf[0] != 'i' {
+		t.Fatalf("read %q then", buf[:n])
+	}
+
+	server.Close()
+	time.Sleep(20 * time.Millisecond)
+	if conn := checkIdleConn(client); conn != nil {
+		t.Fatalf("connection closed by upstream kept %v", conn)
+	}
+}
+
+func TestDialerKey(t *testing.T) {
+	key := func(address string) string {
+		t.Helper()
+		a, err := ResolveAddr(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dialerKey(a)
+	}
+	same := [][2]string{
+		{"tcp://127.0.0.1:80?retries=1&connect_timeout=1s", "tcp://127.0.0.1:80?connect_timeout=1s&retries=1"},
+	}
+	for _, tt := range same {
+		if key(tt[0]) != key(tt[1]) {
+			t.Errorf("%s and %s do not share a dialer", tt[0], tt[1])
+		}
+	}
+	different := [][2]string{
+		{"tcp://127.0.0.1:80", "tcp://127.0.0.1:80?pool_min_idle=1"},
+		{"tcp://127.0.0.1:80", "tcp://127.0.0.1:81"},
+		{"tcp://127.0.0.1:80", "tcp://127.0.0.1:80?via=socks5://127.0.0.1:1080"},
+		{"tcp://127.0.0.1:80?via=socks5://127.0.0.1:1080", "tcp://127.0.0.1:80?via=socks5://127.0.0.1:1081"},
+	}
+	for _, tt := range different {
+		if key(tt[0]) == key(tt[1]) {
+			t.Errorf("%s and %s share a dialer", tt[0], tt[1])
+		}
+	}
+
+	a, _ := NewGroupAddr([]string{"tcp://127.0.0.1:80", "tcp://127.0.0.1:81"}, "")
+	b, _ := NewGroupAddr([]string{"tcp://127.0.0.1:80", "tcp://127.0.0.1:81"}, BalanceLeastConn)
+	if dialerKey(a) == dialerKey(b) {
+		t.Error("groups of different balance share a dialer")
+	}
+
+	// Addresses of the same key get one dialer, a pooled one only from pools
+	address := "tcp://127.0.0.1:1?pool_min_idle=1&connect_timeout=10ms"
+	first, _ := ResolveAddr(address)
+	second, _ := ResolveAddr(address)
+	d := AllDialerPools.GetDailer(first)
+	defer func() {
+		AllDialerPools.mu.Lock()
+		delete(AllDialerPools.dialerpool, dialerKey(first))
+		AllDialerPools.mu.Unlock()
+		d.(*ProxyTunnelPoolDialer).Close()
+	}()
+	if AllDialerPools.GetDailer(second) != d {
+		t.Fatal("dialer not shared")
+	}
+	if _, pooled := newDailer(first).(*ProxyTunnelPoolDialer); pooled {
+		t.Fatal("dialer of a destination pooled")
+	}
+}
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	// defaultMaxDatagram the ethernet MTU
+	defaultMaxDatagram = 1500
+	// maxDatagram the max payload of a udp datagram
+	maxDatagram = 65535
+)
+
+// datagramLimit max size of datagrams on a tunnel, a larger one is dropped and counted.
+// Buffers are pooled, and have one more byte to detect truncation.
+type datagramLimit struct {
+	size      int
+	truncated *Counter
+	pool      sync.Pool
+}
+
+// newDatagramLimit the limit of size on tunnel, zero means 1500
+func newDatagramLimit(tunnel string, size int) *datagramLimit {
+	if size <= 0 {
+		size = defaultMaxDatagram
+	}
+	if size > maxDatagram {
+		size = maxDatagram
+	}
+	l := &datagramLimit{size: size, truncated: GetCounter(tunnel + ".udp_truncated")}
+	l.pool.New = func() interface{} {
+		b := make([]byte, l.size+1)
+		return &b
+	}
+	return l
+}
+
+// buffer get a buffer from pool
+func (l *datagramLimit) buffer() *[]byte {
+	return l.pool.Get().(*[]byte)
+}
+
+// release put the buffer back to pool
+func (l *datagramLimit) release(b *[]byte) {
+	if b != nil {
+		l.pool.Put(b)
+	}
+}
+
+// isTruncated check a datagram of n bytes read from addr, log and count a truncated one
+func (l *datagramLimit) isTruncated(n int, addr net.Addr) bool {
+	if n <= l.size {
+		return false
+	}
+	l.truncated.Add(1)
+	log.Warnf("drop a datagram from %s larger than %d bytes, %d truncated", addr, l.size, l.truncated.Value())
+	return true
+}
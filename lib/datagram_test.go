@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatagramTruncated(t *testing.T) {
+	// The upstream echoes, a "grow" request is replied with 100 bytes
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	received := make(chan string, 8)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+			if string(buf[:n]) == "grow" {
+				upstream.WriteTo(bytes.Repeat([]byte("x"), 100), addr)
+			} else {
+				upstream.WriteTo(buf[:n], addr)
+			}
+		}
+	}()
+
+	in := freeAddr(t, "udp")
+	startTunnel(t, ProxyChainTunnel{
+		InAddr:         "udp://" + in,
+		OutAddr:        "udp://" + upstream.LocalAddr().String(),
+		UDPMaxDatagram: 64,
+	})
+	truncated := GetCounter(t.Name() + ".udp_truncated")
+
+	conn, err := net.Dial("udp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1500)
+
+	// A request over the limit is not sent upstream
+	conn.Write(bytes.Repeat([]byte("y"), 100))
+	conn.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("reply %q %v", buf[:n], err)
+	}
+	if got := <-received; got != "ping" {
+		t.Fatalf("upstream received %d bytes, want ping", len(got))
+	}
+	if v := truncated.Value(); v != 1 {
+		t.Fatalf("%d truncated, want 1", v)
+	}
+
+	// A reply over the limit is not sent back
+	conn.Write([]byte("grow"))
+	<-received
+	conn.Write([]byte("pong"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err = conn.Read(buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("reply %q %v", buf[:n], err)
+	}
+	if v := truncated.Value(); v != 2 {
+		t.Fatalf("%d truncated, want 2", v)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	GetCounter(t.Name() + ".b").Add(3)
+	GetGauge(t.Name() + ".a").Set(-1)
+
+	w := httptest.NewRecorder()
+	ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	want := t.Name() + ".a -1\n" + t.Name() + ".b 3\n"
+	if w.Code != 200 || !strings.Contains(body, want) {
+		t.Fatalf("status %d body %q, want %q", w.Code, body, want)
+	}
+}
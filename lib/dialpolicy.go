@@ -0,0 +1,204 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Dial policy of an outbound address by options, like:
+//
+//	tcp://10.0.0.2:80?connect_timeout=3s&retries=2&backoff=200ms&breaker=5&breaker_cooldown=30s
+//
+// connect_timeout (default 10s) limits every attempt, a failed attempt is retried
+// for retries times after backoff doubled every time with jitter.
+// After breaker (default 0, disabled) failures in a row, the circuit breaker of
+// the address is open and fails fast, after breaker_cooldown (default 30s) one attempt
+// is let through, the breaker is closed if it succeeds, or open again.
+
+const (
+	defaultConnectTimeout  = 10 * time.Second
+	defaultDialBackoff     = 100 * time.Millisecond
+	maxDialBackoff         = 10 * time.Second
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// Breaker states, also the value of gauge <addr>.breaker_state
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStates = []string{"closed", "open", "half-open"}
+
+// dialPolicy connect timeout, retries and circuit breaker of an address
+type dialPolicy struct {
+	timeout  time.Duration
+	retries  int
+	backoff  time.Duration
+	breaker  int
+	cooldown time.Duration
+}
+
+// parseDialPolicy parse dial options of address
+func parseDialPolicy(options url.Values) (*dialPolicy, error) {
+	p := &dialPolicy{timeout: defaultConnectTimeout, backoff: defaultDialBackoff, cooldown: defaultBreakerCooldown}
+	for key, d := range map[string]*time.Duration{"connect_timeout": &p.timeout, "backoff": &p.backoff, "breaker_cooldown": &p.cooldown} {
+		if v := options.Get(key); v != "" {
+			t, err := time.ParseDuration(v)
+			if err != nil || t <= 0 {
+				return nil, errors.New(key + " should be a positive duration: " + v)
+			}
+			*d = t
+		}
+	}
+	for key, n := range map[string]*int{"retries": &p.retries, "breaker": &p.breaker} {
+		if v := options.Get(key); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				return nil, errors.New(key + " should be a non-negative integer: " + v)
+			}
+			*n = i
+		}
+	}
+	return p, nil
+}
+
+// circuitBreaker fail fast an address known broken
+type circuitBreaker struct {
+	addr string
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	// trying an attempt of half-open is running
+	trying bool
+
+	stateGauge *Gauge
+	opened     *Counter
+	rejected   *Counter
+}
+
+// breakers of all addresses, dialers are created for every connection
+var breakers = struct {
+	mu sync.Mutex
+	m  map[string]*circuitBreaker
+}{m: make(map[string]*circuitBreaker)}
+
+// getBreaker the circuit breaker of address
+func getBreaker(addr string) *circuitBreaker {
+	breakers.mu.Lock()
+	defer breakers.mu.Unlock()
+	b, ok := breakers.m[addr]
+	if !ok {
+		b = &circuitBreaker{
+			addr:       addr,
+			stateGauge: GetGauge(addr + ".breaker_state"),
+			opened:     GetCounter(addr + ".breaker_opened"),
+			rejected:   GetCounter(addr + ".breaker_rejected"),
+		}
+		breakers.m[addr] = b
+	}
+	return b
+}
+
+// allow an attempt, false if the breaker is open
+func (b *circuitBreaker) allow(cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= cooldown {
+		b.setState(breakerHalfOpen)
+	}
+	if b.state == breakerOpen || b.state == breakerHalfOpen && b.trying {
+		b.rejected.Add(1)
+		return false
+	}
+	b.trying = b.state == breakerHalfOpen
+	return true
+}
+
+// done record the result of an attempt
+func (b *circuitBreaker) done(err error, threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trying = false
+	if err == nil {
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.state == breakerClosed && b.failures >= threshold {
+		b.openedAt = time.Now()
+		b.opened.Add(1)
+		b.setState(breakerOpen)
+	}
+}
+
+// cancel an attempt stopped by the caller, it is not a failure of the address
+func (b *circuitBreaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trying = false
+}
+
+func (b *circuitBreaker) setState(state int) {
+	log.Warnf("circuit breaker of %s is %s, %d failures", b.addr, breakerStates[state], b.failures)
+	b.state = state
+	b.stateGauge.Set(int64(state))
+}
+
+// dialWithPolicy connect by dial with the policy of addr, attempts and backoff are stopped when ctx is done
+func dialWithPolicy(ctx context.Context, a *ProxyProtoAddr, dial func(ctx context.Context, timeout time.Duration) (net.Conn, error)) (net.Conn, error) {
+	p, err := parseDialPolicy(a.Options)
+	if err != nil {
+		return nil, err
+	}
+	var b *circuitBreaker
+	if p.breaker > 0 {
+		b = getBreaker(a.Addr)
+	}
+
+	backoff := p.backoff
+	for attempt := 0; ; attempt++ {
+		if b != nil && !b.allow(p.cooldown) {
+			return nil, errors.New("circuit breaker is open: " + a.Addr)
+		}
+		conn, err := dial(ctx, p.timeout)
+		if b != nil && err != nil && ctx.Err() != nil {
+			b.cancel()
+		} else if b != nil {
+			b.done(err, p.breaker)
+		}
+		if err == nil || attempt >= p.retries {
+			return conn, err
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("connect %s stopped: %w", a.Addr, ctx.Err())
+		}
+
+		// jitter in [backoff/2, backoff)
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Warnf("connect %s failed: %s, retry %d/%d after %s", a.Addr, err, attempt+1, p.retries, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("connect %s stopped: %w", a.Addr, ctx.Err())
+		}
+		if backoff *= 2; backoff > maxDialBackoff {
+			backoff = maxDialBackoff
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDialPolicy(t *testing.T) {
+	p, err := parseDialPolicy(url.Values{})
+	if err != nil || p.timeout != defaultConnectTimeout || p.retries != 0 || p.breaker != 0 {
+		t.Fatalf("default policy %+v %v", p, err)
+	}
+
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"connect_timeout=0s", "connect_timeout should be a positive duration"},
+		{"backoff=x", "backoff should be a positive duration"},
+		{"breaker_cooldown=-1s", "breaker_cooldown should be a positive duration"},
+		{"retries=-1", "retries should be a non-negative integer"},
+		{"breaker=x", "breaker should be a non-negative integer"},
+	}
+	for _, tt := range tests {
+		options, _ := url.ParseQuery(tt.query)
+		if _, err := parseDialPolicy(options); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.query, err, tt.err)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := getBreaker(t.Name())
+	failed := errors.New("refused")
+
+	// Open after threshold failures in a row
+	for i := 0; i < 3; i++ {
+		if !b.allow(time.Minute) {
+			t.Fatalf("attempt %d rejected by closed breaker", i)
+		}
+		b.done(failed, 3)
+	}
+	if b.state != breakerOpen || b.stateGauge.Value() != breakerOpen || b.opened.Value() != 1 {
+		t.Fatalf("state %s, gauge %d, opened %d", breakerStates[b.state], b.stateGauge.Value(), b.opened.Value())
+	}
+	if b.allow(time.Minute) {
+		t.Fatal("open breaker allowed an attempt")
+	}
+
+	// One attempt of half-open after cooldown, fails to open again
+	b.openedAt = time.Now().Add(-time.Hour)
+	if !b.allow(time.Minute) {
+		t.Fatal("breaker not half-open after cooldown")
+	}
+	if b.allow(time.Minute) {
+		t.Fatal("half-open breaker allowed a second attempt")
+	}
+	b.done(failed, 3)
+	if b.state != breakerOpen || b.opened.Value() != 2 {
+		t.Fatalf("state %s after failed trial", breakerStates[b.state])
+	}
+
+	// A cancelled trial lets the next one through
+	b.openedAt = time.Now().Add(-time.Hour)
+	b.allow(time.Minute)
+	b.cancel()
+	if !b.allow(time.Minute) {
+		t.Fatal("cancelled trial kept the breaker busy")
+	}
+	b.done(nil, 3)
+	if b.state != breakerClosed || b.failures != 0 || b.rejected.Value() != 2 {
+		t.Fatalf("state %s, %d failures, %d rejected", breakerStates[b.state], b.failures, b.rejected.Value())
+	}
+}
+
+func TestDialWithPolicyRetries(t *testing.T) {
+	a, _ := ResolveAddr("tcp://127.0.0.1:1?retries=2&backoff=1ms&breaker=5")
+	a.Addr = t.Name()
+	attempts := 0
+	_, err := dialWithPolicy(context.Background(), a, func(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+		attempts++
+		return nil, errors.New("refused")
+	})
+	if err == nil || attempts != 3 {
+		t.Fatalf("%d attempts, error %v", attempts, err)
+	}
+	if b := getBreaker(a.Addr); b.failures != 3 {
+		t.Fatalf("breaker counted %d failures", b.failures)
+	}
+
+	// The open breaker fails fast
+	getBreaker(a.Addr).done(errors.New("refused"), 4)
+	if _, err := dialWithPolicy(context.Background(), a, nil); err == nil || !strings.Contains(err.Error(), "circuit breaker is open") {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestDialWithPolicyCancel(t *testing.T) {
+	a, _ := ResolveAddr("tcp://127.0.0.1:1?retries=3&backoff=10s&breaker=5")
+	a.Addr = t.Name()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := dialWithPolicy(ctx, a, func(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+		return nil, errors.New("refused")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error %v, want canceled", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("backoff not stopped, returned after %s", d)
+	}
+
+	// A dial stopped by ctx is not a failure of the address
+	_, err = dialWithPolicy(ctx, a, func(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+		return nil, ctx.Err()
+	})
+	if b := getBreaker(a.Addr); err == nil || b.failures != 1 {
+		t.Fatalf("breaker counted %d failures, error %v", b.failures, err)
+	}
+}
+
+func TestDrainStopsDialRetries(t *testing.T) {
+	refused := freeAddr(t, "tcp")
+	in := freeAddr(t, "tcp")
+	stop := startTunnel(t, ProxyChainTunnel{
+		InAddr:       "tcp://" + in,
+		OutAddr:      "tcp://" + refused + "?retries=5&backoff=10s",
+		DrainTimeout: 200 * time.Millisecond,
+	})
+
+	conn, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The first attempt is refused, the tunnel waits to retry
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	stop()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("drain took %s, over the drain timeout", d)
+	}
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Framing carry datagrams on a stream inbound to a udp outbound, like DNS over TCP:
+//
+//	proxysocket "tcp://0.0.0.0:53?framing=u16" udp://8.8.8.8:53
+//	proxysocket "unix:///var/run/syslog.socket?framing=u32" udp://10.0.0.2:514
+//
+// Every datagram is prefixed with its length in big endian,
+// u16 is 2 bytes (RFC 1035 over TCP), u32 is 4 bytes.
+// A datagram larger than udp_max_datagram of the tunnel is dropped and counted in both directions.
+
+// framingSize bytes of length prefix
+func framingSize(framing string) (int, error) {
+	switch framing {
+	case "u16":
+		return 2, nil
+	case "u32":
+		return 4, nil
+	}
+	return 0, errors.New("unsupported framing: " + framing)
+}
+
+// exchangeFramed unpack datagrams from inbound stream to udp, and pack replies back
+func (c *ProxyChainConn) exchangeFramed(to *ProxyProtoAddr) {
+	size, err := framingSize(c.framing)
+	if err != nil {
+		log.Errorf("framing from %s to %s: %s", c.inConn.RemoteAddr(), to.Addr, err)
+		c.Close()
+		return
+	}
+
+	log.Infof("framed tunnel opened %s <-> [%s, %s] <-> %s", c.inConn.RemoteAddr(), c.inConn.LocalAddr(), c.outConn.LocalAddr(), c.outConn.RemoteAddr())
+
+	inConn, outConn := c.inConn, c.outConn
+	datagrams := c.datagrams
+	if datagrams == nil {
+		datagrams = newDatagramLimit(to.Addr, defaultMaxDatagram)
+	}
+	defer c.afterDone(func() {
+		inConn.Close()
+		outConn.Close()
+	})()
+
+	// proxy replies from upstream back to inbound
+	replied := make(chan struct{})
+	go func() {
+		defer close(replied)
+		pbuf := datagrams.buffer()
+		defer datagrams.release(pbuf)
+		buf, prefix := *pbuf, make([]byte, size)
+		for {
+			n, err := outConn.Read(buf)
+			if err != nil {
+				break
+			}
+			if datagrams.isTruncated(n, outConn.RemoteAddr()) {
+				continue
+			}
+			if size == 2 {
+				binary.BigEndian.PutUint16(prefix, uint16(n))
+			} else {
+				binary.BigEndian.PutUint32(prefix, uint32(n))
+			}
+			frame := net.Buffers{prefix, buf[:n]}
+			if _, err := frame.WriteTo(inConn); err != nil {
+				log.Errorf("write framed %d bytes to %s error: %v", n, inConn.RemoteAddr(), err)
+				break
+			}
+		}
+	}()
+
+	// proxy requests from inbound to upstream
+	count := 0
+	pbuf := datagrams.buffer()
+	defer datagrams.release(pbuf)
+	buf := *pbuf
+	for {
+		if _, err := io.ReadFull(inConn, buf[:size]); err != nil {
+			if err != io.EOF {
+				log.Errorf("read frame from %s error: %v", inConn.RemoteAddr(), err)
+			}
+			break
+		}
+		var n uint32
+		if size == 2 {
+			n = uint32(binary.BigEndian.Uint16(buf))
+		} else {
+			n = binary.BigEndian.Uint32(buf)
+		}
+		if n > maxDatagram {
+			log.Errorf("frame of %d bytes from %s is larger than a datagram", n, inConn.RemoteAddr())
+			break
+		}
+		if datagrams.isTruncated(int(n), inConn.RemoteAddr()) {
+			// The frame is skipped, the next one follows it on the stream
+			if _, err := io.CopyN(io.Discard, inConn, int64(n)); err != nil {
+				break
+			}
+			continue
+		}
+		if _, err := io.ReadFull(inConn, buf[:n]); err != nil {
+			log.Errorf("read frame of %d bytes from %s error: %v", n, inConn.RemoteAddr(), err)
+			break
+		}
+		if _, err := outConn.Write(buf[:n]); err != nil {
+			log.Errorf("send %d bytes to %s error: %v", n, to.Addr, err)
+			break
+		}
+		count++
+	}
+
+	// The client may close write and still wait replies
+	timeout := c.udpTimeout
+	if timeout <= 0 {
+		timeout = defaultUDPTimeout
+	}
+	outConn.SetReadDeadline(time.Now().Add(timeout))
+	<-replied
+
+	log.Infof("transfor %d datagrams from %s to %s", count, inConn.RemoteAddr(), to.Addr)
+	c.Close()
+}
@@ -0,0 +1,158 @@
+package lib
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// frame a datagram prefixed with its length of size bytes
+func frame(size int, n uint32, data string) []byte {
+	b := make([]byte, size)
+	if size == 2 {
+		binary.BigEndian.PutUint16(b, uint16(n))
+	} else {
+		binary.BigEndian.PutUint32(b, n)
+	}
+	return append(b, data...)
+}
+
+// readFrame read a framed datagram of size bytes prefix
+func readFrame(t *testing.T, conn net.Conn, size int) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	prefix := make([]byte, size)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		t.Fatal(err)
+	}
+	n := binary.BigEndian.Uint32(append(make([]byte, 4-size), prefix...))
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+// startUDPRecorder a udp echo server sending every datagram it receives to the channel
+func startUDPRecorder(t *testing.T) (net.PacketConn, <-chan string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	received := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn, received
+}
+
+func TestFramingRoundTrip(t *testing.T) {
+	echo := startUDPEcho(t)
+	for _, tt := range []struct {
+		framing string
+		size    int
+	}{{"u16", 2}, {"u32", 4}} {
+		in := freeAddr(t, "tcp")
+		startTunnel(t, ProxyChainTunnel{
+			Name:       t.Name() + "/" + tt.framing,
+			InAddr:     "tcp://" + in + "?framing=" + tt.framing,
+			OutAddr:    "udp://" + echo.LocalAddr().String(),
+			UDPTimeout: 100 * time.Millisecond,
+		})
+
+		conn, err := net.Dial("tcp", in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Two frames in one write are two datagrams
+		conn.Write(append(frame(tt.size, 5, "hello"), frame(tt.size, 3, "abc")...))
+		for _, want := range []string{"hello", "abc"} {
+			if got := readFrame(t, conn, tt.size); got != want {
+				t.Errorf("%s: reply %q, want %q", tt.framing, got, want)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestFramingOversize(t *testing.T) {
+	upstream, received := startUDPRecorder(t)
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{
+		InAddr:         "tcp://" + in + "?framing=u32",
+		OutAddr:        "udp://" + upstream.LocalAddr().String(),
+		UDPMaxDatagram: 16,
+		UDPTimeout:     100 * time.Millisecond,
+	})
+	truncated := GetCounter(t.Name() + ".udp_truncated")
+	before := truncated.Value()
+
+	conn, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A frame over udp_max_datagram is skipped, the next one is sent
+	big := string(make([]byte, 100))
+	conn.Write(append(frame(4, 100, big), frame(4, 2, "ok")...))
+	if got := readFrame(t, conn, 4); got != "ok" {
+		t.Fatalf("reply %q", got)
+	}
+	if got := <-received; got != "ok" {
+		t.Fatalf("upstream received %q", got)
+	}
+	if n := truncated.Value() - before; n != 1 {
+		t.Fatalf("%d truncated, want 1", n)
+	}
+
+	// A length over any datagram closes the stream
+	conn.Write(frame(4, 1<<20, "x"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Fatalf("read %v, want closed", err)
+	}
+}
+
+func TestFramingTruncatedAtEOF(t *testing.T) {
+	upstream, received := startUDPRecorder(t)
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{
+		InAddr:  "tcp://" + in + "?framing=u16",
+		OutAddr: "udp://" + upstream.LocalAddr().String(),
+		// No replies are waited after EOF
+		UDPTimeout: 100 * time.Millisecond,
+	})
+
+	for _, partial := range [][]byte{{0}, frame(2, 5, "hel")} {
+		conn, err := net.Dial("tcp", in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(partial)
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := conn.Read(make([]byte, 16)); err != io.EOF {
+			t.Fatalf("%v: read %d %v, want EOF", partial, n, err)
+		}
+		conn.Close()
+	}
+	select {
+	case got := <-received:
+		t.Fatalf("truncated frame sent upstream %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
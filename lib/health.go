@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Health check probe backends of an upstream group, like:
+//
+//	health_check:
+//	  interval: 5s
+//	  timeout: 2s
+//	  rise: 2
+//	  fall: 3
+//	  send: ping
+//	  expect: pong
+//
+// A stream backend is up if connected, send and expect are optional.
+// A udp backend needs send, it is up if any reply (or a reply starting with expect).
+// A backend is down after fall failures in a row, up again after rise successes in a row.
+
+// HealthCheck options of probing backends
+type HealthCheck struct {
+	Interval time.Duration `mapstructure:"interval"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	Rise     int           `mapstructure:"rise"`
+	Fall     int           `mapstructure:"fall"`
+	Send     string        `mapstructure:"send"`
+	Expect   string        `mapstructure:"expect"`
+}
+
+// Validate check options of health check
+func (h *HealthCheck) Validate() error {
+	if h.Interval < 0 || h.Timeout < 0 || h.Rise < 0 || h.Fall < 0 {
+		return errors.New("should not be negative")
+	}
+	if h.Expect != "" && h.Send == "" {
+		return errors.New("expect needs send")
+	}
+	return nil
+}
+
+// withDefaults fill options not given: 5s interval, 2s timeout, rise 2 and fall 3
+func (h HealthCheck) withDefaults() HealthCheck {
+	if h.Interval == 0 {
+		h.Interval = 5 * time.Second
+	}
+	if h.Timeout == 0 {
+		h.Timeout = 2 * time.Second
+	}
+	if h.Rise == 0 {
+		h.Rise = 2
+	}
+	if h.Fall == 0 {
+		h.Fall = 3
+	}
+	return h
+}
+
+// healthChecker probe every backend of group until stopped
+type healthChecker struct {
+	check  HealthCheck
+	tunnel string
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// startHealthCheck probe the backends of group dialer
+func startHealthCheck(tunnel string, check HealthCheck, d *ProxyTunnelGroupDialer) *healthChecker {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &healthChecker{check: check.withDefaults(), tunnel: tunnel, ctx: ctx, cancel: cancel}
+	for _, b := range d.backends {
+		go h.run(b)
+	}
+	return h
+}
+
+// Stop all probes
+func (h *healthChecker) Stop() {
+	h.cancel()
+}
+
+func (h *healthChecker) run(b *groupBackend) {
+	if b.addr.IsReverse {
+		log.Warnf("not check reverse backend %s of %s, agents keep it", b.addr.Addr, h.tunnel)
+		return
+	}
+
+	ticker := time.NewTicker(h.check.Interval)
+	defer ticker.Stop()
+
+	// successes or failures in a row
+	count := 0
+	for {
+		h.record(b, &count, h.probe(b.addr))
+
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// record the result of a probe, count successes or failures in a row against the state
+// of backend, it is down after fall failures and up after rise successes
+func (h *healthChecker) record(b *groupBackend, count *int, err error) {
+	up := b.isUp()
+	if (err == nil) == up {
+		*count = 0
+	} else if *count++; up && *count >= h.check.Fall {
+		atomic.StoreInt32(&b.down, 1)
+		*count = 0
+		log.Warnf("backend %s of %s is down: %s", b.addr.Addr, h.tunnel, err)
+	} else if !up && *count >= h.check.Rise {
+		atomic.StoreInt32(&b.down, 0)
+		*count = 0
+		log.Infof("backend %s of %s is up", b.addr.Addr, h.tunnel)
+	}
+}
+
+// probe connect the backend by its dialer, send and expect the reply if given
+func (h *healthChecker) probe(a *ProxyProtoAddr) error {
+	dailer := healthProbeDialer(a)
+	if dailer == nil {
+		return errors.New("no dailer of " + a.Addr)
+	}
+	ctx, cancel := context.WithTimeout(h.ctx, h.check.Timeout)
+	defer cancel()
+	conn, err := dialFor(ctx, dailer, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if h.check.Send == "" {
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(h.check.Timeout))
+	if _, err := conn.Write([]byte(h.check.Send)); err != nil {
+		return err
+	}
+	// Any reply is expected without expect
+	buf := make([]byte, len(h.check.Expect))
+	if len(buf) == 0 {
+		buf = make([]byte, 1)
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(buf, []byte(h.check.Expect)) {
+		return errors.New("unexpected reply")
+	}
+	return nil
+}
+
+// healthProbeDialer the dialer of backend with its tls, proxies and mux, an idle pool
+// is passed by for a connection just dialed
+func healthProbeDialer(a *ProxyProtoAddr) ProxyTunnelDialer {
+	dailer := AllDialerPools.GetDailer(a)
+	if pool, ok := dailer.(*ProxyTunnelPoolDialer); ok {
+		return pool.ProxyTunnelDialer
+	}
+	return dailer
+}
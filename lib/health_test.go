@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthRiseFall(t *testing.T) {
+	h := &healthChecker{check: HealthCheck{Rise: 2, Fall: 3}, tunnel: t.Name()}
+	b := &groupBackend{addr: &ProxyProtoAddr{Addr: "tcp://127.0.0.1:1"}}
+	failed := errors.New("refused")
+
+	count := 0
+	for i, tt := range []struct {
+		err error
+		up  bool
+	}{
+		{failed, true},
+		{failed, true},
+		// A success resets the failures in a row
+		{nil, true},
+		{failed, true},
+		{failed, true},
+		{failed, false},
+		{nil, false},
+		{failed, false},
+		{nil, false},
+		{nil, true},
+		{nil, true},
+	} {
+		h.record(b, &count, tt.err)
+		if b.isUp() != tt.up {
+			t.Fatalf("probe %d: up %v, want %v", i, b.isUp(), tt.up)
+		}
+	}
+}
+
+// flappingServer a tcp server replying pong to ping in two writes, it can be stopped and
+// started again on the same address
+type flappingServer struct {
+	t    *testing.T
+	addr string
+	mu   sync.Mutex
+	l    net.Listener
+}
+
+func (f *flappingServer) start() {
+	f.t.Helper()
+	l, err := net.Listen("tcp", f.addr)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.l = l
+	f.mu.Unlock()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				if n, _ := conn.Read(buf); string(buf[:n]) != "ping" {
+					return
+				}
+				// The reply is split, a probe reads all of expect
+				conn.Write([]byte("po"))
+				time.Sleep(10 * time.Millisecond)
+				conn.Write([]byte("ng"))
+			}()
+		}
+	}()
+}
+
+func (f *flappingServer) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.l.Close()
+}
+
+// waitBackend wait the backend is up or down
+func waitBackend(t *testing.T, b *groupBackend, up bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.isUp() != up {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend %s up %v, want %v", b.addr.Addr, b.isUp(), up)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthFlapping(t *testing.T) {
+	flapping := &flappingServer{t: t, addr: freeAddr(t, "tcp")}
+	flapping.start()
+	defer flapping.stop()
+	steady := &flappingServer{t: t, addr: freeAddr(t, "tcp")}
+	steady.start()
+	defer steady.stop()
+
+	d := newTestGroup(t, "", "tcp://"+flapping.addr, "tcp://"+steady.addr)
+	check := HealthCheck{Interval: 20 * time.Millisecond, Timeout: 500 * time.Millisecond, Rise: 2, Fall: 2, Send: "ping", Expect: "pong"}
+	h := startHealthCheck(t.Name(), check, d)
+	defer h.Stop()
+
+	// A split reply is expected as a whole
+	for _, b := range d.backends {
+		if err := h.probe(b.addr); err != nil {
+			t.Fatalf("probe %s: %v", b.addr.Addr, err)
+		}
+	}
+
+	// Clients fail over to the steady backend while the other is down
+	flapping.stop()
+	waitBackend(t, d.backends[0], false)
+	for i := 0; i < 4; i++ {
+		conn, err := d.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.RemoteAddr().String() != steady.addr {
+			t.Fatalf("connected %s, want %s", conn.RemoteAddr(), steady.addr)
+		}
+		conn.Close()
+	}
+
+	// Up again after rise successes, clients are spread again
+	flapping.start()
+	waitBackend(t, d.backends[0], true)
+	picked := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		conn, err := d.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[conn.RemoteAddr().String()] = true
+		conn.Close()
+	}
+	if !picked[flapping.addr] || !picked[steady.addr] {
+		t.Fatalf("connected %v, want both backends", picked)
+	}
+	if atomic.LoadInt32(&d.backends[1].down) != 0 {
+		t.Fatal("steady backend down")
+	}
+}
@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr a local address free to listen on
+func freeAddr(t *testing.T, network string) string {
+	t.Helper()
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().String()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startEcho a tcp server writing back what it reads, then half-closing
+func startEcho(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	return l
+}
+
+// startUDPEcho a udp server writing back every datagram
+func startUDPEcho(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// tunnelState the state of a tunnel by name, -1 if not registered
+func tunnelState(name string) int32 {
+	tunnels.mu.Lock()
+	defer tunnels.mu.Unlock()
+	if s, ok := tunnels.status[name]; ok {
+		return s.get()
+	}
+	return -1
+}
+
+// startTunnel run the tunnel until the test ends, it returns when the tunnel is serving.
+// The returned stop cancels the tunnel and waits it to return.
+func startTunnel(t *testing.T, p ProxyChainTunnel) (stop func()) {
+	t.Helper()
+	if p.Name == "" {
+		p.Name = t.Name()
+	}
+	if p.DrainTimeout == 0 {
+		p.DrainTimeout = time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx) }()
+
+	stopped := false
+	stop = func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		<-done
+		tunnels.mu.Lock()
+		delete(tunnels.status, p.Name)
+		tunnels.mu.Unlock()
+	}
+	t.Cleanup(stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnelState(p.Name) != tunnelServing {
+		select {
+		case err := <-done:
+			stopped = true
+			t.Fatalf("tunnel %s stopped: %v", p.Name, err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel %s not serving", p.Name)
+		}
+	}
+	return stop
+}
+
+// roundTrip write msg to conn and read the same length back
+func roundTrip(t *testing.T, conn net.Conn, msg string) string {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+// tcpPair a connected pair of tcp connections, client and server
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
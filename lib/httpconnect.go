@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTP CONNECT proxy server, the destination comes from client, like:
+//
+//	proxysocket "http-connect://0.0.0.0:8080?user=alice&pass=secret"
+//
+// Proxy-Authorization of basic auth is required when user is given.
+
+const httpConnectTimeout = 10 * time.Second
+
+// NewProxyTunnelHTTPConnectServer new a tcp server parsing CONNECT request from clients
+func NewProxyTunnelHTTPConnectServer(addr *ProxyProtoAddr) ProxyTunnelServer {
+	s := NewProxyTunnelTCPServer().(*ProxyTunnelTCPServer)
+	user, pass := addr.Options.Get("user"), addr.Options.Get("pass")
+	s.handshake = func(ctx context.Context, conn net.Conn, ch chan<- *ProxyChainConn) (*ProxyChainConn, error) {
+		return httpConnectHandshake(conn, user, pass)
+	}
+	return s
+}
+
+// httpConnectHandshake read the CONNECT request, returns a connection waiting response
+func httpConnectHandshake(conn net.Conn, user, pass string) (*ProxyChainConn, error) {
+	conn.SetDeadline(time.Now().Add(httpConnectTimeout))
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadRequest, "")
+		return nil, err
+	}
+
+	if req.Method != http.MethodConnect {
+		writeHTTPStatus(conn, http.StatusMethodNotAllowed, "")
+		return nil, errors.New("not a CONNECT request: " + req.Method)
+	}
+
+	if user != "" && !checkProxyAuthorization(req.Header.Get("Proxy-Authorization"), user, pass) {
+		writeHTTPStatus(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"proxysocket\"\r\n")
+		return nil, errors.New("proxy authorization failed to " + req.Host)
+	}
+
+	to, err := newDestAddr("tcp", req.Host)
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadRequest, "")
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	log.Infof("http connect from %s to %s", conn.RemoteAddr(), req.Host)
+
+	// The client may send data after request, it is buffered in reader
+	c := &ProxyChainConn{inConn: &bufferedConn{Conn: conn, r: br}, Dest: to}
+	c.connected = func(outConn net.Conn, err error) error {
+		if err != nil {
+			return writeHTTPStatus(conn, http.StatusBadGateway, "")
+		}
+		_, err = fmt.Fprintf(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		return err
+	}
+	return c, nil
+}
+
+// checkProxyAuthorization check basic auth of Proxy-Authorization
+func checkProxyAuthorization(auth, user, pass string) bool {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+	expected := []byte(user + ":" + pass)
+	return subtle.ConstantTimeCompare(decoded, expected) == 1
+}
+
+// writeHTTPStatus write a response without body and close the connection
+func writeHTTPStatus(conn net.Conn, code int, header string) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), header)
+	return err
+}
+
+// bufferedConn read the buffered data before the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// CloseWrite half-close the connection under
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// httpConnect ask a http proxy on conn to connect the target host:port
+func httpConnect(conn net.Conn, target, user, pass string) (net.Conn, error) {
+	auth := ""
+	if user != "" {
+		auth = "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)) + "\r\n"
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", target, target, auth); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http connect %s failed: %s", target, resp.Status)
+	}
+
+	// The data after response is buffered in reader
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// httpConnectStatus send a raw request to a http-connect inbound, the status code of response
+func httpConnectStatus(t *testing.T, in, request string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, request)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("%q: %v", request, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHTTPConnect(t *testing.T) {
+	echo := startEcho(t)
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{InAddr: "http-connect://" + in + "?user=alice&pass=secret"})
+
+	conn, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	relay, err := httpConnect(conn, echo.Addr().String(), "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := roundTrip(t, relay, "hello"); got != "hello" {
+		t.Fatalf("echo %q", got)
+	}
+}
+
+func TestHTTPConnectStatus(t *testing.T) {
+	echo := startEcho(t).Addr().String()
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{InAddr: "http-connect://" + in + "?user=alice&pass=secret"})
+
+	auth := "Proxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n"
+	tests := []struct {
+		name    string
+		request string
+		status  int
+	}{
+		{"no authorization", "CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\n\r\n", http.StatusProxyAuthRequired},
+		// alice:wrong
+		{"wrong password", "CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\nProxy-Authorization: Basic YWxpY2U6d3Jvbmc=\r\n\r\n", http.StatusProxyAuthRequired},
+		{"not basic", "CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\nProxy-Authorization: Bearer secret\r\n\r\n", http.StatusProxyAuthRequired},
+		{"method", "GET http://" + echo + "/ HTTP/1.1\r\nHost: " + echo + "\r\n" + auth + "\r\n", http.StatusMethodNotAllowed},
+		{"upstream down", "CONNECT " + freeAddr(t, "tcp") + " HTTP/1.1\r\n" + auth + "\r\n", http.StatusBadGateway},
+		{"no port", "CONNECT localhost HTTP/1.1\r\n" + auth + "\r\n", http.StatusBadRequest},
+		{"malformed", "CONNECT\r\n\r\n", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if status := httpConnectStatus(t, in, tt.request); status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+	}
+}
+
+func TestHTTPConnectHostOptions(t *testing.T) {
+	client, server := tcpPair(t)
+	io.WriteString(client, "CONNECT [x]:1?pool_min_idle=7&z=[]:80 HTTP/1.1\r\n\r\n")
+	if c, err := httpConnectHandshake(server, "", ""); err == nil {
+		t.Fatalf("destination %q options %v accepted", c.Dest.Host, c.Dest.Options)
+	}
+
+	client, server = tcpPair(t)
+	io.WriteString(client, "CONNECT db.internal:5432 HTTP/1.1\r\n\r\n")
+	c, err := httpConnectHandshake(server, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Dest.Host != "db.internal:5432" || len(c.Dest.Options) != 0 || !strings.HasPrefix(c.Dest.Addr, "tcp://") {
+		t.Fatalf("destination %+v", c.Dest)
+	}
+}
@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter a metric only increasing, like: dns.udp_truncated
+type Counter struct {
+	value int64
+}
+
+// Add n to the counter
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+// Value of the counter
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// Gauge a metric of current value, like: tcp://10.0.0.2:80.breaker_state
+type Gauge struct {
+	value int64
+}
+
+// Set the value of gauge
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.value, v)
+}
+
+// Add n to the gauge, n may be negative
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+// Value of the gauge
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// metrics all counters and gauges by name
+var metrics = struct {
+	mu       sync.Mutex
+	counters map[string]*Counter
+	gauges   map[string]*Gauge
+}{counters: make(map[string]*Counter), gauges: make(map[string]*Gauge)}
+
+// GetCounter get the counter of name, create it if not exists
+func GetCounter(name string) *Counter {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	c, ok := metrics.counters[name]
+	if !ok {
+		c = new(Counter)
+		metrics.counters[name] = c
+	}
+	return c
+}
+
+// Counters values of all counters by name
+func Counters() map[string]int64 {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	values := make(map[string]int64, len(metrics.counters))
+	for name, c := range metrics.counters {
+		values[name] = c.Value()
+	}
+	return values
+}
+
+// GetGauge get the gauge of name, create it if not exists
+func GetGauge(name string) *Gauge {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	g, ok := metrics.gauges[name]
+	if !ok {
+		g = new(Gauge)
+		metrics.gauges[name] = g
+	}
+	return g
+}
+
+// Gauges values of all gauges by name
+func Gauges() map[string]int64 {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	values := make(map[string]int64, len(metrics.gauges))
+	for name, g := range metrics.gauges {
+		values[name] = g.Value()
+	}
+	return values
+}
+
+// ServeMetrics answer all counters and gauges by http, every line of body is a metric
+// with its value sorted by name, like: dns.udp_truncated 3
+func ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	values := Counters()
+	for name, v := range Gauges() {
+		values[name] = v
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var body strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&body, "%s %d\n", name, values[name])
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, body.String())
+}
@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mirror send a copy of every datagram of a udp tunnel to more outbounds,
+// replies come only from the primary outbound, the replies of mirrors are discarded.
+// A udp mirror keeps one socket, a unix mirror gets one connection for every datagram.
+// Copies are sent in order by one sender of every mirror, a copy is dropped and counted
+// when the queue of a slow mirror is full.
+
+const (
+	// mirrorWriteTimeout how long to send a copy to a mirror
+	mirrorWriteTimeout = 3 * time.Second
+	// mirrorQueue copies waiting to be sent to a mirror
+	mirrorQueue = 256
+	// mirrorRedialInterval a udp mirror of hostname is dialed again, the address may change
+	mirrorRedialInterval = 30 * time.Second
+)
+
+// udpMirror an outbound receiving copies of datagrams
+type udpMirror struct {
+	addr    *ProxyProtoAddr
+	errors  *Counter
+	dropped *Counter
+
+	queue chan []byte
+	start sync.Once
+	stop  sync.Once
+	done  chan struct{}
+
+	// conn the socket of udp mirror dialed at dialedAt, only used by the sender
+	conn     net.Conn
+	dialedAt time.Time
+}
+
+// newUDPMirror a mirror to addr of tunnel
+func newUDPMirror(tunnel string, addr *ProxyProtoAddr) *udpMirror {
+	return &udpMirror{
+		addr:    addr,
+		errors:  GetCounter(tunnel + ".mirror_errors"),
+		dropped: GetCounter(tunnel + ".mirror_dropped"),
+		queue:   make(chan []byte, mirrorQueue),
+		done:    make(chan struct{}),
+	}
+}
+
+// send queue a copy of data to the mirror, it does not block
+func (m *udpMirror) send(data []byte) {
+	m.start.Do(func() { go m.run() })
+	select {
+	case m.queue <- data:
+	default:
+		m.dropped.Add(1)
+		log.Warnf("drop a copy of %d bytes to mirror %s, %d queued, %d dropped", len(data), m.addr.Addr, mirrorQueue, m.dropped.Value())
+	}
+}
+
+// run send the queued copies until the mirror is closed
+func (m *udpMirror) run() {
+	defer func() {
+		if m.conn != nil {
+			m.conn.Close()
+		}
+	}()
+	for {
+		select {
+		case data := <-m.queue:
+			if err := m.write(data); err != nil {
+				m.errors.Add(1)
+				log.Errorf("mirror %d bytes to %s error: %v", len(data), m.addr.Addr, err)
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *udpMirror) write(data []byte) error {
+	dailer := AllDialerPools.GetDailer(m.addr)
+	if dailer == nil {
+		return errors.New("no dailer")
+	}
+
+	if !dailer.IsConnectionless() {
+		conn, err := dailer.GetConn()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout))
+		_, err = conn.Write(data)
+		return err
+	}
+
+	if m.conn != nil && time.Since(m.dialedAt) >= mirrorRedialInterval && !isIPHost(m.addr.Host) {
+		m.conn.Close()
+		m.conn = nil
+	}
+	if m.conn == nil {
+		conn, err := dailer.GetConn()
+		if err != nil {
+			return err
+		}
+		m.conn, m.dialedAt = conn, time.Now()
+	}
+	if _, err := m.conn.Write(data); err != nil {
+		// Dial a new socket for next datagram
+		m.conn.Close()
+		m.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close the mirror, the sender stops and closes the socket
+func (m *udpMirror) Close() {
+	m.stop.Do(func() { close(m.done) })
+}
+
+// isMirrorAddr a mirror is a plain udp or unix address
+func isMirrorAddr(addr *ProxyProtoAddr) bool {
+	return (addr.IsUDP || addr.IsUnix) && !addr.IsMux && !addr.IsReverse && !addr.IsAgent
+}
+
+// isIPHost the host of host:port is an ip address
+func isIPHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	return err == nil && net.ParseIP(strings.Split(host, "%")[0]) != nil
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMirrorInOrder(t *testing.T) {
+	echo := startUDPEcho(t)
+	mirror, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mirror.Close()
+
+	in := freeAddr(t, "udp")
+	startTunnel(t, ProxyChainTunnel{
+		InAddr:      "udp://" + in,
+		OutAddr:     "udp://" + echo.LocalAddr().String(),
+		MirrorAddrs: []string{"udp://" + mirror.LocalAddr().String()},
+	})
+
+	conn, err := net.Dial("udp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	const count = 50
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(conn, "%d", i)
+	}
+
+	buf := make([]byte, 64)
+	for i := 0; i < count; i++ {
+		mirror.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := mirror.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("mirror received %d copies: %v", i, err)
+		}
+		if string(buf[:n]) != fmt.Sprint(i) {
+			t.Fatalf("copy %d is %s, out of order", i, buf[:n])
+		}
+	}
+}
+
+func TestMirrorQueueFull(t *testing.T) {
+	addr, _ := ResolveAddr("udp://127.0.0.1:9")
+	m := newUDPMirror(t.Name(), addr)
+	defer m.Close()
+	// No sender, copies stay in queue
+	m.start.Do(func() {})
+
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < mirrorQueue+10; i++ {
+		m.send([]byte("copy"))
+	}
+	if n := m.dropped.Value(); n != 10 {
+		t.Fatalf("dropped %d copies, want 10", n)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatalf("%d goroutines after sending, %d before", n, goroutines)
+	}
+}
+
+func TestMirrorRedial(t *testing.T) {
+	// The same port on two loopback addresses, the name of mirror moves between them
+	first, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	_, port, _ := net.SplitHostPort(first.LocalAddr().String())
+	second, err := net.ListenPacket("udp", "127.0.0.2:"+port)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer second.Close()
+	hosts := useHostsResolver(t, nil, "127.0.0.1 mirror.test\n")
+
+	addr, _ := ResolveAddr("udp://mirror.test:" + port)
+	m := newUDPMirror(t.Name(), addr)
+	defer func() {
+		if m.conn != nil {
+			m.conn.Close()
+		}
+	}()
+	receive := func(conn net.PacketConn, want string) {
+		t.Helper()
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("received %q %v, want %q", buf[:n], err, want)
+		}
+	}
+
+	if err := m.write([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	receive(first, "one")
+
+	// The socket is kept until the interval, then the name is resolved again
+	rewriteHosts(t, hosts, "127.0.0.2 mirror.test\n")
+	m.write([]byte("two"))
+	receive(first, "two")
+	m.dialedAt = m.dialedAt.Add(-mirrorRedialInterval)
+	m.write([]byte("three"))
+	receive(second, "three")
+}
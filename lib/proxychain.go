@@ -1,11 +1,17 @@
 package lib
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
-	"sync"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/hashicorp/yamux"
 )
 
 // ProxyChainConn a concrate inbound and outbound connection pair
@@ -15,8 +21,36 @@ type ProxyChainConn struct {
 	UDPData         []byte
 	outConn         net.Conn
 	IsClosed        bool
+
+	// Dest the destination from client handshake, used instead of tunnel outbound
+	Dest *ProxyProtoAddr
+	// connected tell the client handshake the result of connecting to Dest
+	connected func(outConn net.Conn, err error) error
+
+	udpTimeout time.Duration
+	// idleTimeout close a stream without data in both directions, zero never
+	idleTimeout time.Duration
+	// framing of datagrams on a stream inbound
+	framing string
+	// sessions of udp clients, nil to exchange a datagram on a new connection
+	sessions *udpSessionTable
+	// datagrams limit the size of replies, udpBuf of UDPData is released to it on close
+	datagrams *datagramLimit
+	udpBuf    *[]byte
+	// shaper rates and quotas of the tunnel, nil if not shaped
+	shaper *shaper
+	// ctx of the tunnel, the connections are closed when it is done
+	ctx context.Context
 }
 
+// udpWriter write a datagram back to udp client
+type udpWriter interface {
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+}
+
+// defaultUDPTimeout wait a udp response
+const defaultUDPTimeout = 3 * time.Second
+
 // Exchange on connection-orintend or connectionless
 
 // connection 1 : Client <-1-> ProxyServer
@@ -37,26 +71,88 @@ func (c *ProxyChainConn) Exchange(to *ProxyProtoAddr) {
 		return
 	}
 
-	dailer := AllDialerPools.GetDailer(to)
+	// Terminate TLS before dialing to upstream
+	if tlsConn, ok := c.inConn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Errorf("tls handshake with %s failed: %s", tlsConn.RemoteAddr(), err)
+			c.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		log.Infof("tls handshake with %s done, server name: %s", tlsConn.RemoteAddr(), tlsConn.ConnectionState().ServerName)
+	}
+
+	var dailer ProxyTunnelDialer
+	if c.Dest != nil {
+		dailer = newDailer(to)
+	} else {
+		dailer = AllDialerPools.GetDailer(to)
+	}
 
 	if dailer == nil {
 		log.Errorf("get a dailer to %s failed", to.Addr)
+		c.notifyConnected(errors.New("no dailer"))
 		c.Close()
 		return
 	}
 
-	if dailer.SupportMultiplex() {
-		log.Infof("support multiplex")
+	// Connectionless upstream keeps a socket for every udp client
+	if c.InUDPRemoteAddr != nil && c.sessions != nil && dailer.IsConnectionless() {
+		c.sessions.forward(c, to, dailer)
+		c.Close()
+		return
 	}
 
-	if conn, err := dailer.GetConn(); err == nil {
+	if dailer.SupportMultiplex() {
+		if stream, err := openStream(c.dialContext(), dailer); err == nil {
+			c.outConn = stream
+		} else {
+			log.Errorf("open stream to %s failed: %s", to.Addr, err)
+			c.notifyConnected(err)
+			c.Close()
+			return
+		}
+	} else if conn, err := dialFor(c.dialContext(), dailer, c.clientAddr()); err == nil {
 		c.outConn = conn
 	} else {
 		log.Errorf("connect %s failed: %s", to.Addr, err)
+		c.notifyConnected(err)
 		c.Close()
 		return
 	}
 
+	// Keep the client address for upstream by PROXY protocol
+	if version := backendAddr(c.outConn, to).Options.Get("proxy_protocol"); version != "" && c.InUDPRemoteAddr == nil {
+		if err := writeProxyHeader(c.outConn, version, c.inConn.RemoteAddr(), c.inConn.LocalAddr()); err != nil {
+			log.Errorf("send proxy protocol header to %s failed: %s", to.Addr, err)
+			c.notifyConnected(err)
+			c.Close()
+			return
+		}
+	}
+
+	if err := c.notifyConnected(nil); err != nil {
+		log.Errorf("reply connected of %s to client failed: %s", to.Addr, err)
+		c.Close()
+		return
+	}
+
+	// Shape reading in both directions of a stream inbound
+	if c.shaper != nil && c.InUDPRemoteAddr == nil {
+		cs := c.shaper.client(c.inConn.RemoteAddr())
+		defer c.shaper.release(cs)
+		ctx := c.dialContext()
+		c.inConn = &shapedConn{Conn: c.inConn, s: c.shaper, cs: cs, upload: true, ctx: ctx}
+		c.outConn = &shapedConn{Conn: c.outConn, s: c.shaper, cs: cs, ctx: ctx}
+	}
+
+	// on stream inbound with framed datagrams
+	if c.framing != "" && dailer.IsConnectionless() {
+		c.exchangeFramed(to)
+		return
+	}
+
 	// on UDP Server Mode
 	if c.InUDPRemoteAddr != nil {
 		// send request to proxy service by dialer
@@ -69,8 +165,18 @@ func (c *ProxyChainConn) Exchange(to *ProxyProtoAddr) {
 		}
 
 		// receive data response
-		conn.SetReadDeadline(time.Now().Add(time.Second * 3))
-		buf := make([]byte, 1500)
+		timeout := c.udpTimeout
+		if timeout <= 0 {
+			timeout = defaultUDPTimeout
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		datagrams := c.datagrams
+		if datagrams == nil {
+			datagrams = newDatagramLimit(to.Addr, defaultMaxDatagram)
+		}
+		pbuf := datagrams.buffer()
+		defer datagrams.release(pbuf)
+		buf := *pbuf
 		readSize, err := conn.Read(buf)
 
 		if err != nil {
@@ -79,9 +185,17 @@ func (c *ProxyChainConn) Exchange(to *ProxyProtoAddr) {
 				log.Errorf("read data(%d done) from %s error: %v", readSize, to.Addr, err)
 			}
 		}
+		if datagrams.isTruncated(readSize, conn.RemoteAddr()) {
+			c.Close()
+			return
+		}
+		if c.shaper != nil && readSize > 0 && !c.shaper.allowDatagram(c.InUDPRemoteAddr, readSize, false) {
+			c.Close()
+			return
+		}
 
 		// Write response back
-		writeSize, err := c.inConn.(*net.UDPConn).WriteToUDP(buf[:readSize], c.InUDPRemoteAddr)
+		writeSize, err := c.inConn.(udpWriter).WriteToUDP(buf[:readSize], c.InUDPRemoteAddr)
 		if writeSize != readSize || err != nil {
 			log.Errorf("write %d bytes(%d done) to %s, error: %v", readSize, writeSize, c.InUDPRemoteAddr.String(), err)
 		}
@@ -90,78 +204,10 @@ func (c *ProxyChainConn) Exchange(to *ProxyProtoAddr) {
 		return
 	}
 
-	wg := sync.WaitGroup{}
-
-	inConnClosed := false
-	outConnClosed := false
-
-	cp := func(src, dst net.Conn) {
-		defer wg.Done()
-		// buf := make([]byte, 16*1024) // 16 KB
-		if !c.IsClosed {
-
-			// On the paire connection any is Closed
-			// There is no need to wait recieve more data and copy to the other
-			timeoutCount := 0
-			var totalSize int64 = 0
-			for !inConnClosed && !outConnClosed {
-
-				src.SetReadDeadline(time.Now().Add(time.Second * 3))
-
-				// Reader From src, Write to dst
-				size, err := io.CopyBuffer(dst, src, nil)
-				totalSize += size
-				if err != nil {
-					if opErr, ok := err.(*net.OpError); ok {
-						if opErr.Timeout() {
-							timeoutCount++
-						} else {
-							log.Errorf("read data(%d done) from %s, opError: %v", totalSize, to.Addr, *opErr)
-							// If error, then close all connection
-							if !opErr.Temporary() {
-								inConnClosed = true
-							}
-						}
-					} else {
-						// error yet, shoule response back to client?
-						log.Errorf("read data(%d done) from %s, error: %v", totalSize, to.Addr, err)
-						inConnClosed = true
-					}
-				} else {
-					timeoutCount = 0
-				}
-
-				if timeoutCount == 0 {
-					if src == c.inConn {
-						inConnClosed = true
-					} else {
-						outConnClosed = true
-					}
-				}
-
-				// It should be long for some tcp using keep-alive and no heartbeat data
-				if timeoutCount >= 600 { // 30 minutes
-					log.Infof("check read from unix to tcp, limit unix data input time of %d minutes", 30)
-					break
-				}
-			}
-			log.Infof("transfor %d bytes from %s to %s", totalSize, src.RemoteAddr(), dst.RemoteAddr())
-
-		}
-	}
-
 	log.Infof("tunnel opened %s <-> [%s, %s] <-> %s", c.inConn.RemoteAddr(), c.inConn.LocalAddr(), c.outConn.LocalAddr(), c.outConn.RemoteAddr())
 
-	// transfer data
-
-	wg.Add(2)
-	// proxy request from inbound to outbound
-	go cp(c.inConn, c.outConn)
-	// proxy response from outbound to inbound
-	go cp(c.outConn, c.inConn)
-
-	// Block no timeout
-	wg.Wait()
+	// transfer data until both directions are done
+	c.relay()
 
 	if !c.IsClosed {
 		if c.inConn == nil {
@@ -178,6 +224,130 @@ func (c *ProxyChainConn) Exchange(to *ProxyProtoAddr) {
 
 }
 
+// relay copy data in both directions until both are done. EOF of one direction is passed
+// on by CloseWrite, so the reply to a half-closed request still comes back, an error
+// closes both connections to stop the other direction. Data is copied between the
+// unwrapped connections, by splice if they are tcp or unix.
+func (c *ProxyChainConn) relay() {
+	inConn, outConn := c.inConn, c.outConn
+	inPending, inRaw := unwrapConn(inConn)
+	outPending, outRaw := unwrapConn(outConn)
+	active := time.Now().UnixNano()
+
+	var abortOnce sync.Once
+	abort := func() {
+		abortOnce.Do(func() {
+			inConn.Close()
+			outConn.Close()
+		})
+	}
+
+	defer c.afterDone(abort)()
+
+	var wg sync.WaitGroup
+	cp := func(dst, src, rawDst, rawSrc net.Conn, pending []byte) {
+		defer wg.Done()
+		size, err := copyStream(rawDst, rawSrc, pending, &active, c.idleTimeout)
+		log.Infof("transfor %d bytes from %s to %s", size, src.RemoteAddr(), dst.RemoteAddr())
+		if err != nil {
+			// The other direction is aborted
+			if !errors.Is(err, net.ErrClosed) {
+				log.Errorf("read data(%d done) from %s, error: %v", size, src.RemoteAddr(), err)
+			}
+			abort()
+			return
+		}
+		if err := closeWrite(dst); err != nil {
+			log.Infof("half-close %s failed: %s, close both", dst.RemoteAddr(), err)
+			abort()
+		}
+	}
+
+	wg.Add(2)
+	// proxy request from inbound to outbound
+	go cp(outConn, inConn, outRaw, inRaw, inPending)
+	// proxy response from outbound to inbound
+	go cp(inConn, outConn, inRaw, outRaw, outPending)
+	wg.Wait()
+}
+
+// copyStream copy pending bytes and then src to dst until EOF (nil error) or an error,
+// or idle in both directions for idleTimeout if not zero
+func copyStream(dst, src net.Conn, pending []byte, active *int64, idleTimeout time.Duration) (int64, error) {
+	var total int64
+	if len(pending) > 0 {
+		n, err := dst.Write(pending)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	if idleTimeout <= 0 {
+		size, err := io.Copy(dst, src)
+		return total + size, err
+	}
+	for {
+		// Check idle at a half of timeout, the other direction may be active
+		src.SetReadDeadline(time.Now().Add(idleTimeout / 2))
+		size, err := io.Copy(dst, src)
+		total += size
+		if size > 0 {
+			atomic.StoreInt64(active, time.Now().UnixNano())
+		}
+		if opErr, ok := err.(net.Error); ok && opErr.Timeout() {
+			if time.Since(time.Unix(0, atomic.LoadInt64(active))) < idleTimeout {
+				continue
+			}
+			return total, errors.New("idle for " + idleTimeout.String())
+		}
+		return total, err
+	}
+}
+
+// closeWrite shut down writing of a tcp, unix, tls or mux connection, reading goes on
+func closeWrite(conn net.Conn) error {
+	switch c := conn.(type) {
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite()
+	case *yamux.Stream:
+		// Close of a stream only sends FIN, it still reads until FIN from the other side
+		return c.Close()
+	}
+	return errors.New("half-close not supported")
+}
+
+// afterDone call f when the tunnel is stopped, until the returned stop is called
+func (c *ProxyChainConn) afterDone(f func()) (stop func() bool) {
+	if c.ctx == nil {
+		return func() bool { return false }
+	}
+	return context.AfterFunc(c.ctx, f)
+}
+
+// dialContext ctx of connecting upstream, dial and retries stop with the connection
+func (c *ProxyChainConn) dialContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// clientAddr the address of client
+func (c *ProxyChainConn) clientAddr() net.Addr {
+	if c.InUDPRemoteAddr != nil {
+		return c.InUDPRemoteAddr
+	}
+	return c.inConn.RemoteAddr()
+}
+
+// notifyConnected call back the client handshake if it waits
+func (c *ProxyChainConn) notifyConnected(err error) error {
+	if c.connected == nil {
+		return nil
+	}
+	return c.connected(c.outConn, err)
+}
+
 // Close connection pair
 func (c *ProxyChainConn) Close() {
 	if c == nil {
@@ -186,6 +356,10 @@ func (c *ProxyChainConn) Close() {
 	if c.IsClosed {
 		return
 	}
+	if c.udpBuf != nil {
+		c.datagrams.release(c.udpBuf)
+		c.UDPData, c.udpBuf = nil, nil
+	}
 	// UDP Inbound Connection is a udp server, chould not be closed here
 	if c.inConn != nil && !strings.HasPrefix(c.inConn.LocalAddr().Network(), "udp") {
 		c.inConn.Close()
@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamHalfClose(t *testing.T) {
+	// The upstream replies after the request is half-closed, a while later
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		time.Sleep(300 * time.Millisecond)
+		conn.Write(append([]byte("reply to "), request...))
+	}()
+
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{
+		InAddr:            "tcp://" + in,
+		OutAddr:           "tcp://" + upstream.Addr().String(),
+		StreamIdleTimeout: time.Second,
+	})
+
+	conn, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "request")
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil || string(reply) != "reply to request" {
+		t.Fatalf("reply %q %v", reply, err)
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	echo := startEcho(t)
+	for _, timeout := range []time.Duration{0, 200 * time.Millisecond} {
+		in := freeAddr(t, "tcp")
+		startTunnel(t, ProxyChainTunnel{
+			Name:              t.Name() + "/" + timeout.String(),
+			InAddr:            "tcp://" + in,
+			OutAddr:           "tcp://" + echo.Addr().String(),
+			StreamIdleTimeout: timeout,
+		})
+
+		conn, err := net.Dial("tcp", in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, conn, "hello")
+
+		// Idle streams are kept without a timeout
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+		if closed := err == io.EOF; closed != (timeout > 0) {
+			t.Fatalf("idle timeout %s: read %v", timeout, err)
+		}
+	}
+}
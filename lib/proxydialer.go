@@ -1,15 +1,19 @@
 package lib
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"io"
 	"net"
 	"sync"
+	"time"
 )
 
-// DialerPools A Upstream Connection Pool
+// DialerPools A Upstream Connection Pool, dialers are keyed by address with options
 type DialerPools struct {
 	mu         *sync.Mutex
-	dialerpool map[*ProxyProtoAddr]ProxyTunnelDialer
+	dialerpool map[string]ProxyTunnelDialer
 }
 
 // ProxyTunnelDialer a abstract of different proto client
@@ -25,22 +29,50 @@ type ProxyTunnelDialer interface {
 // AllDialerPools All DialerPools in Memory
 var AllDialerPools = &DialerPools{
 	mu:         new(sync.Mutex),
-	dialerpool: make(map[*ProxyProtoAddr]ProxyTunnelDialer),
+	dialerpool: make(map[string]ProxyTunnelDialer),
 }
 
 // GetDailer response a exits connection or create one
 func (d *DialerPools) GetDailer(addr *ProxyProtoAddr) ProxyTunnelDialer {
+	key := dialerKey(addr)
+
 	d.mu.Lock()
-	if v, ok := d.dialerpool[addr]; ok {
-		if v.SupportMultiplex() {
-			return v
-		}
+	defer d.mu.Unlock()
+	if v, ok := d.dialerpool[key]; ok {
+		return v
+	}
+
+	p := newDailer(addr)
+	if p == nil {
+		return nil
+	}
+	// Keep idle connections if pool options given
+	if pool := newPoolDialer(p, addr); pool != nil {
+		p = pool
 	}
-	d.mu.Unlock()
+	d.dialerpool[key] = p
+	return p
+}
 
+// newDailer create a dialer of address, not kept by pools and without idle connections.
+// Destinations from client handshakes are dialed by it, or every destination would stay
+// in memory.
+func newDailer(addr *ProxyProtoAddr) ProxyTunnelDialer {
 	var p ProxyTunnelDialer
 
-	if addr.IsTCP {
+	if len(addr.Group) > 0 {
+		p = new(ProxyTunnelGroupDialer)
+	} else if addr.SRV != "" {
+		p = new(ProxyTunnelSRVDialer)
+	} else if len(addr.Via) > 0 {
+		p = new(ProxyTunnelViaDialer)
+	} else if addr.IsMux {
+		p = new(ProxyTunnelMuxDialer)
+	} else if addr.IsReverse {
+		p = new(ProxyTunnelReverseDialer)
+	} else if addr.IsTLS {
+		p = new(ProxyTunnelTLSDialer)
+	} else if addr.IsTCP {
 		p = new(ProxyTunnelTCPDialer)
 	} else if addr.IsUnix {
 		p = new(ProxyTunnelUnixDialer)
@@ -52,12 +84,20 @@ func (d *DialerPools) GetDailer(addr *ProxyProtoAddr) ProxyTunnelDialer {
 	}
 
 	p.SetAddr(addr)
+	return p
+}
 
+// Close all dialers after tunnels are stopped, idle pools stop filling and mux sessions
+// are closed. A dialer is created again when used.
+func (d *DialerPools) Close() {
 	d.mu.Lock()
-	d.dialerpool[addr] = p
-	d.mu.Unlock()
-
-	return p
+	defer d.mu.Unlock()
+	for key, p := range d.dialerpool {
+		if c, ok := p.(io.Closer); ok {
+			c.Close()
+		}
+		delete(d.dialerpool, key)
+	}
 }
 
 // ProxyTunnelTCPDialer a tcp connection dailer
@@ -82,11 +122,17 @@ func (p *ProxyTunnelTCPDialer) SetAddr(a *ProxyProtoAddr) {
 
 // GetConn create a tcp connection
 func (p *ProxyTunnelTCPDialer) GetConn() (net.Conn, error) {
+	return p.GetConnFor(context.Background(), nil)
+}
+
+// GetConnFor create a tcp connection until ctx is done
+func (p *ProxyTunnelTCPDialer) GetConnFor(ctx context.Context, client net.Addr) (net.Conn, error) {
 	if p.Addr == nil {
 		return nil, errors.New("not init dailer address")
 	}
-	addr := p.Addr.TCPAddr
-	conn, err := net.Dial(addr.Network(), addr.String())
+	conn, err := dialWithPolicy(ctx, p.Addr, func(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+		return dialAddr(ctx, p.Addr, timeout)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -98,6 +144,63 @@ func (p *ProxyTunnelTCPDialer) GetStream() (interface{}, error) {
 	return nil, errors.New("Origin Unix not support multiplex")
 }
 
+// ProxyTunnelTLSDialer a tls over tcp connection dailer
+type ProxyTunnelTLSDialer struct {
+	Addr *ProxyProtoAddr
+}
+
+// SupportMultiplex tls dialer not support multiplex
+func (p *ProxyTunnelTLSDialer) SupportMultiplex() bool {
+	return false
+}
+
+// IsConnectionless tls dialer is connection-oriented
+func (p *ProxyTunnelTLSDialer) IsConnectionless() bool {
+	return false
+}
+
+//SetAddr set a tls ProxyProtoAddr
+func (p *ProxyTunnelTLSDialer) SetAddr(a *ProxyProtoAddr) {
+	p.Addr = a
+}
+
+// GetConn create a tcp connection and finish tls handshake
+func (p *ProxyTunnelTLSDialer) GetConn() (net.Conn, error) {
+	return p.GetConnFor(context.Background(), nil)
+}
+
+// GetConnFor create a tcp connection and finish tls handshake until ctx is done
+func (p *ProxyTunnelTLSDialer) GetConnFor(ctx context.Context, client net.Addr) (net.Conn, error) {
+	if p.Addr == nil || p.Addr.TLSConfig == nil {
+		return nil, errors.New("not init dailer address")
+	}
+	// The timeout includes handshake
+	conn, err := dialWithPolicy(ctx, p.Addr, func(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+		deadline := time.Now().Add(timeout)
+		conn, err := dialAddr(ctx, p.Addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, p.Addr.TLSConfig)
+		tlsConn.SetDeadline(deadline)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// GetStream TLSDialer not support multiplex
+func (p *ProxyTunnelTLSDialer) GetStream() (interface{}, error) {
+	return nil, errors.New("Origin TLS not support multiplex")
+}
+
 // ProxyTunnelUnixDialer a unix connection dailer
 type ProxyTunnelUnixDialer struct {
 	Addr *ProxyProtoAddr
@@ -120,11 +223,17 @@ func (p *ProxyTunnelUnixDialer) SetAddr(a *ProxyProtoAddr) {
 
 // GetConn create a unix connection
 func (p *ProxyTunnelUnixDialer) GetConn() (net.Conn, error) {
+	return p.GetConnFor(context.Background(), nil)
+}
+
+// GetConnFor create a unix connection until ctx is done
+func (p *ProxyTunnelUnixDialer) GetConnFor(ctx context.Context, client net.Addr) (net.Conn, error) {
 	if p.Addr == nil {
 		return nil, errors.New("not init dailer address")
 	}
-	addr := p.Addr.UnixAddr
-	conn, err := net.Dial(addr.Network(), addr.String())
+	conn, err := dialWithPolicy(ctx, p.Addr, func(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+		return dialAddr(ctx, p.Addr, timeout)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -156,13 +265,17 @@ func (p *ProxyTunnelUDPDialer) SetAddr(a *ProxyProtoAddr) {
 	p.Addr = a
 }
 
-// GetConn create a unix connection
+// GetConn create a udp connection
 func (p *ProxyTunnelUDPDialer) GetConn() (net.Conn, error) {
+	return p.GetConnFor(context.Background(), nil)
+}
+
+// GetConnFor create a udp connection, a hostname is resolved until ctx is done
+func (p *ProxyTunnelUDPDialer) GetConnFor(ctx context.Context, client net.Addr) (net.Conn, error) {
 	if p.Addr == nil {
 		return nil, errors.New("not init dailer address")
 	}
-	addr := p.Addr.UDPAddr
-	conn, err := net.Dial(addr.Network(), addr.String())
+	conn, err := dialAddr(ctx, p.Addr, defaultConnectTimeout)
 	if err != nil {
 		return nil, err
 	}
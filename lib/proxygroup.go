@@ -0,0 +1,309 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Upstream group spread connections of a tunnel to many outbounds, like:
+//
+//	upstreams:
+//	  - tcp://10.0.0.2:80?weight=3
+//	  - tcp://10.0.0.3:80
+//	balance: least-conn
+//
+// Strategies: round-robin (default), least-conn, random and hash of client ip,
+// weight=1 is the default of a backend.
+
+// Balance strategies of upstream group
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceLeastConn  = "least-conn"
+	BalanceRandom     = "random"
+	BalanceHash       = "hash"
+)
+
+// checkBalance check the strategy of upstream group
+func checkBalance(balance string) error {
+	switch balance {
+	case "", BalanceRoundRobin, BalanceLeastConn, BalanceRandom, BalanceHash:
+		return nil
+	}
+	return errors.New("unsupported balance: " + balance)
+}
+
+// NewGroupAddr resolve the upstreams as one outbound address
+func NewGroupAddr(upstreams []string, balance string) (*ProxyProtoAddr, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+	if err := checkBalance(balance); err != nil {
+		return nil, err
+	}
+
+	pa := &ProxyProtoAddr{Balance: balance}
+	addrs := make([]string, 0, len(upstreams))
+	for i, upstream := range upstreams {
+		a, err := ResolveAddr(upstream)
+		if err != nil {
+			return nil, err
+		}
+		if a.IsAgent || a.IsDynamic() || a.SRV != "" {
+			return nil, errors.New("invalid upstream: " + upstream)
+		}
+		if _, err := backendWeight(a); err != nil {
+			return nil, err
+		}
+		if i > 0 && a.IsUDP != pa.IsUDP {
+			return nil, errors.New("upstreams should be all udp or all stream: " + upstream)
+		}
+		pa.IsUDP, pa.IsTCP, pa.IsUnix = a.IsUDP, pa.IsTCP || a.IsTCP, pa.IsUnix || a.IsUnix
+		pa.Group = append(pa.Group, a)
+		addrs = append(addrs, a.Addr)
+	}
+	pa.Addr = "group://" + strings.Join(addrs, ",")
+	return pa, nil
+}
+
+// backendWeight the weight option of a backend, default 1
+func backendWeight(a *ProxyProtoAddr) (int, error) {
+	v := a.Options.Get("weight")
+	if v == "" {
+		return 1, nil
+	}
+	w, err := strconv.Atoi(v)
+	if err != nil || w <= 0 {
+		return 0, errors.New("weight should be a positive integer: " + a.Addr)
+	}
+	return w, nil
+}
+
+// ProxyTunnelClientDialer a dialer choosing upstream by the client address
+type ProxyTunnelClientDialer interface {
+	GetConnFor(ctx context.Context, client net.Addr) (net.Conn, error)
+}
+
+// dialFor get a connection of client from dailer, retries stop when ctx is done
+func dialFor(ctx context.Context, dailer ProxyTunnelDialer, client net.Addr) (net.Conn, error) {
+	if cd, ok := dailer.(ProxyTunnelClientDialer); ok {
+		return cd.GetConnFor(ctx, client)
+	}
+	return dailer.GetConn()
+}
+
+// groupBackend a backend of upstream group
+type groupBackend struct {
+	addr   *ProxyProtoAddr
+	weight int
+	// current weight of smooth weighted round-robin
+	current int
+	// conns active connections
+	conns int64
+	// down marked by health check
+	down int32
+}
+
+func (b *groupBackend) isUp() bool {
+	return atomic.LoadInt32(&b.down) == 0
+}
+
+// ProxyTunnelGroupDialer select a backend of upstream group for every connection
+type ProxyTunnelGroupDialer struct {
+	Addr *ProxyProtoAddr
+
+	mu       sync.Mutex
+	backends []*groupBackend
+}
+
+// SupportMultiplex group dialer not support multiplex, its backends may
+func (p *ProxyTunnelGroupDialer) SupportMultiplex() bool {
+	return false
+}
+
+// IsConnectionless group dialer is connectionless if backends are udp
+func (p *ProxyTunnelGroupDialer) IsConnectionless() bool {
+	return p.Addr != nil && p.Addr.IsUDP
+}
+
+// SetAddr set a group ProxyProtoAddr
+func (p *ProxyTunnelGroupDialer) SetAddr(a *ProxyProtoAddr) {
+	p.Addr = a
+	p.backends = make([]*groupBackend, 0, len(a.Group))
+	for _, member := range a.Group {
+		w, _ := backendWeight(member)
+		p.backends = append(p.backends, &groupBackend{addr: member, weight: w})
+	}
+}
+
+// GetConn connect a backend without client
+func (p *ProxyTunnelGroupDialer) GetConn() (net.Conn, error) {
+	return p.GetConnFor(context.Background(), nil)
+}
+
+// GetStream group not support multiplex
+func (p *ProxyTunnelGroupDialer) GetStream() (interface{}, error) {
+	return nil, errors.New("upstream group not support multiplex")
+}
+
+// GetConnFor connect the backend selected for client, try another one if failed
+func (p *ProxyTunnelGroupDialer) GetConnFor(ctx context.Context, client net.Addr) (net.Conn, error) {
+	if p.Addr == nil || len(p.backends) == 0 {
+		return nil, errors.New("not init dailer address")
+	}
+
+	tried := make(map[*groupBackend]bool, len(p.backends))
+	var lastErr error
+	for len(tried) < len(p.backends) {
+		b := p.pick(client, tried)
+		tried[b] = true
+
+		dailer := AllDialerPools.GetDailer(b.addr)
+		if dailer == nil {
+			lastErr = errors.New("no dailer of " + b.addr.Addr)
+			continue
+		}
+		conn, err := dialFor(ctx, dailer, nil)
+		if err != nil {
+			log.Warnf("connect backend %s failed: %s", b.addr.Addr, err)
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		atomic.AddInt64(&b.conns, 1)
+		return &groupConn{Conn: conn, backend: b}, nil
+	}
+	return nil, lastErr
+}
+
+// candidates the backends not tried, only up ones if any
+func (p *ProxyTunnelGroupDialer) candidates(tried map[*groupBackend]bool) []*groupBackend {
+	var up, down []*groupBackend
+	for _, b := range p.backends {
+		if tried[b] {
+			continue
+		}
+		if b.isUp() {
+			up = append(up, b)
+		} else {
+			down = append(down, b)
+		}
+	}
+	if len(up) > 0 {
+		return up
+	}
+	return down
+}
+
+// pick a backend not tried by balance strategy
+func (p *ProxyTunnelGroupDialer) pick(client net.Addr, tried map[*groupBackend]bool) *groupBackend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	backends := p.candidates(tried)
+
+	switch p.Addr.Balance {
+	case BalanceLeastConn:
+		var best *groupBackend
+		for _, b := range backends {
+			// fewest connections for every weight
+			if best == nil || atomic.LoadInt64(&b.conns)*int64(best.weight) < atomic.LoadInt64(&best.conns)*int64(b.weight) {
+				best = b
+			}
+		}
+		return best
+	case BalanceRandom:
+		total := 0
+		for _, b := range backends {
+			total += b.weight
+		}
+		n := rand.Intn(total)
+		for _, b := range backends {
+			if n -= b.weight; n < 0 {
+				return b
+			}
+		}
+	case BalanceHash:
+		if client != nil {
+			return hashBackend(backends, clientIP(client))
+		}
+	}
+
+	// smooth weighted round-robin, like nginx
+	var best *groupBackend
+	total := 0
+	for _, b := range backends {
+		b.current += b.weight
+		total += b.weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// hashBackend select a backend by rendezvous hashing of key, only a few clients move when backends change
+func hashBackend(backends []*groupBackend, key string) *groupBackend {
+	var best *groupBackend
+	bestScore := 0.0
+	for _, b := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(b.addr.Addr))
+		// uniform in (0, 1), weighted score is w / -ln(u)
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := float64(b.weight) / -math.Log(u)
+		if best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+// clientIP the ip of client, or the address of unix client
+func clientIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	return addr.String()
+}
+
+// groupConn a connection to a backend, counted until closed
+type groupConn struct {
+	net.Conn
+	backend *groupBackend
+	once    sync.Once
+}
+
+// CloseWrite half-close the connection under
+func (c *groupConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *groupConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.backend.conns, -1)
+	})
+	return c.Conn.Close()
+}
+
+// backendAddr the address of backend connected by conn, or to itself
+func backendAddr(conn net.Conn, to *ProxyProtoAddr) *ProxyProtoAddr {
+	if gc, ok := conn.(*groupConn); ok {
+		return gc.backend.addr
+	}
+	return to
+}
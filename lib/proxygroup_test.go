@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestGroup a group dialer of upstreams without dialing
+func newTestGroup(t *testing.T, balance string, upstreams ...string) *ProxyTunnelGroupDialer {
+	t.Helper()
+	a, err := NewGroupAddr(upstreams, balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(ProxyTunnelGroupDialer)
+	d.SetAddr(a)
+	return d
+}
+
+// pickCounts pick n times, count the picks by address
+func pickCounts(d *ProxyTunnelGroupDialer, client net.Addr, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[d.pick(client, nil).addr.Host]++
+	}
+	return counts
+}
+
+func TestNewGroupAddrInvalid(t *testing.T) {
+	tests := []struct {
+		upstreams []string
+		balance   string
+		err       string
+	}{
+		{nil, "", "no upstreams"},
+		{[]string{"tcp://127.0.0.1:1"}, "fastest", "unsupported balance"},
+		{[]string{"tcp://127.0.0.1:1?weight=0"}, "", "positive integer"},
+		{[]string{"tcp://127.0.0.1:1?weight=x"}, "", "positive integer"},
+		{[]string{"tcp://127.0.0.1:1", "udp://127.0.0.1:2"}, "", "all udp or all stream"},
+		{[]string{"socks5://127.0.0.1:1"}, "", "invalid upstream"},
+		{[]string{"srv://_a._tcp.example.com"}, "", "invalid upstream"},
+	}
+	for _, tt := range tests {
+		if _, err := NewGroupAddr(tt.upstreams, tt.balance); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v %s: error %v, want %q", tt.upstreams, tt.balance, err, tt.err)
+		}
+	}
+}
+
+func TestGroupRoundRobin(t *testing.T) {
+	d := newTestGroup(t, "", "tcp://127.0.0.1:1?weight=3", "tcp://127.0.0.1:2", "tcp://127.0.0.1:3")
+
+	// Smooth weighted round-robin spreads the heavy backend
+	var seq []string
+	for i := 0; i < 5; i++ {
+		seq = append(seq, d.pick(nil, nil).addr.Host[len("127.0.0.1:"):])
+	}
+	if got := strings.Join(seq, ""); got != "12131" {
+		t.Fatalf("sequence %s, want 12131", got)
+	}
+
+	counts := pickCounts(d, nil, 500)
+	if counts["127.0.0.1:1"] != 300 || counts["127.0.0.1:2"] != 100 || counts["127.0.0.1:3"] != 100 {
+		t.Fatalf("counts %v, want 300 100 100", counts)
+	}
+}
+
+func TestGroupLeastConn(t *testing.T) {
+	d := newTestGroup(t, BalanceLeastConn, "tcp://127.0.0.1:1?weight=2", "tcp://127.0.0.1:2", "tcp://127.0.0.1:3")
+	conns := []int64{3, 2, 1}
+	for i, b := range d.backends {
+		atomic.StoreInt64(&b.conns, conns[i])
+	}
+	// 3/2 is the fewest connections for weight
+	if b := d.pick(nil, nil); b.addr.Host != "127.0.0.1:3" {
+		t.Fatalf("picked %s, want 127.0.0.1:3", b.addr.Host)
+	}
+	atomic.StoreInt64(&d.backends[2].conns, 2)
+	if b := d.pick(nil, nil); b.addr.Host != "127.0.0.1:1" {
+		t.Fatalf("picked %s, want 127.0.0.1:1", b.addr.Host)
+	}
+}
+
+func TestGroupRandom(t *testing.T) {
+	d := newTestGroup(t, BalanceRandom, "tcp://127.0.0.1:1?weight=3", "tcp://127.0.0.1:2")
+	counts := pickCounts(d, nil, 4000)
+	if n := counts["127.0.0.1:1"]; n < 2700 || n > 3300 {
+		t.Fatalf("counts %v, want about 3000 1000", counts)
+	}
+}
+
+func TestGroupHash(t *testing.T) {
+	upstreams := []string{"tcp://127.0.0.1:1", "tcp://127.0.0.1:2", "tcp://127.0.0.1:3"}
+	d := newTestGroup(t, BalanceHash, upstreams...)
+
+	moved := 0
+	for i := 0; i < 100; i++ {
+		client := &net.TCPAddr{IP: net.IPv4(10, 0, byte(i), 1), Port: 1000 + i}
+		b := d.pick(client, nil)
+		// The same client ip on any port goes to the same backend
+		if again := d.pick(&net.TCPAddr{IP: client.IP, Port: 2}, nil); again != b {
+			t.Fatalf("client %s moved from %s to %s", client.IP, b.addr.Host, again.addr.Host)
+		}
+
+		// Only clients of a removed backend move
+		removed := d.backends[2]
+		if b2 := d.pick(client, map[*groupBackend]bool{removed: true}); b2.addr.Host != b.addr.Host {
+			if b != removed {
+				t.Fatalf("client %s moved from %s to %s", client.IP, b.addr.Host, b2.addr.Host)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved == 100 {
+		t.Fatalf("%d of 100 clients on the removed backend", moved)
+	}
+}
+
+func TestGroupSkipsDown(t *testing.T) {
+	d := newTestGroup(t, "", "tcp://127.0.0.1:1", "tcp://127.0.0.1:2")
+	atomic.StoreInt32(&d.backends[0].down, 1)
+	if counts := pickCounts(d, nil, 10); counts["127.0.0.1:2"] != 10 {
+		t.Fatalf("counts %v, want only the up backend", counts)
+	}
+	// All down, try them anyway
+	atomic.StoreInt32(&d.backends[1].down, 1)
+	if counts := pickCounts(d, nil, 10); counts["127.0.0.1:1"] != 5 {
+		t.Fatalf("counts %v, want both backends", counts)
+	}
+}
+
+func TestGroupFailover(t *testing.T) {
+	echo := startEcho(t)
+	refused := freeAddr(t, "tcp")
+	d := newTestGroup(t, "", "tcp://"+refused, "tcp://"+echo.Addr().String())
+
+	for i := 0; i < 2; i++ {
+		conn, err := d.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.RemoteAddr().String() != echo.Addr().String() {
+			t.Fatalf("connected %s, want %s", conn.RemoteAddr(), echo.Addr())
+		}
+		if n := atomic.LoadInt64(&d.backends[1].conns); n != 1 {
+			t.Fatalf("%d connections counted", n)
+		}
+		conn.Close()
+		conn.Close()
+		if n := atomic.LoadInt64(&d.backends[1].conns); n != 0 {
+			t.Fatalf("%d connections counted after close", n)
+		}
+	}
+
+	// All backends fail
+	d = newTestGroup(t, "", "tcp://"+refused)
+	if conn, err := d.GetConn(); conn != nil || err == nil {
+		t.Fatalf("connected %v %v", conn, err)
+	}
+}
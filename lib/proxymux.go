@@ -0,0 +1,345 @@
+package lib
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Multiplex between two proxysocket, many logical streams on one long-lived connection,
+// the streams have flow control and the connection is kept alive by ping, like:
+//
+//	proxysocket tcp://0.0.0.0:8080 mux+tcp://10.0.0.2:9000
+//	proxysocket mux+tcp://0.0.0.0:9000 tcp://127.0.0.1:80
+//
+// Options: keepalive=30s ping interval, window=262144 max bytes of stream window
+
+// muxLogWriter send yamux logs to tunnel log
+type muxLogWriter struct{}
+
+func (w muxLogWriter) Write(p []byte) (int, error) {
+	log.Warnf("mux: %s", strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// newMuxConfig build yamux config from address options
+func newMuxConfig(addr *ProxyProtoAddr) *yamux.Config {
+	c := yamux.DefaultConfig()
+	c.LogOutput = muxLogWriter{}
+	if v := addr.Options.Get("keepalive"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			c.KeepAliveInterval = d
+		} else {
+			log.Warnf("ignore invalid mux keepalive %s of %s", v, addr.Addr)
+		}
+	}
+	if v := addr.Options.Get("window"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 32); err == nil && n >= 256*1024 {
+			c.MaxStreamWindowSize = uint32(n)
+		} else {
+			log.Warnf("ignore invalid mux window %s of %s, at least 262144", v, addr.Addr)
+		}
+	}
+	return c
+}
+
+// muxNetAddr the network and address under multiplex, a hostname is resolved by listen
+func muxNetAddr(addr *ProxyProtoAddr) (string, string) {
+	if addr.IsUnix {
+		return addr.UnixAddr.Network(), addr.UnixAddr.String()
+	}
+	return addrNetwork(addr), addr.Host
+}
+
+// listenSession listen for connections of sessions, in tls of a mux+tls, reverse+tls address
+func listenSession(addr *ProxyProtoAddr) (net.Listener, error) {
+	if addr.IsTLS && (addr.TLSConfig == nil || len(addr.TLSConfig.Certificates) == 0) {
+		return nil, errors.New("no cert and key given")
+	}
+	listener, err := net.Listen(muxNetAddr(addr))
+	if err != nil {
+		return nil, err
+	}
+	if addr.IsTLS {
+		return tls.NewListener(listener, addr.TLSConfig), nil
+	}
+	return listener, nil
+}
+
+// dialSession connect for a session in timeout, and finish tls handshake of a mux+tls, agent+tls address
+func dialSession(ctx context.Context, addr *ProxyProtoAddr, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	conn, err := dialAddr(ctx, addr, timeout)
+	if err != nil || !addr.IsTLS {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, addr.TLSConfig)
+	tlsConn.SetDeadline(deadline)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// ProxyTunnelMuxDialer open streams on a long-lived tcp or unix connection
+type ProxyTunnelMuxDialer struct {
+	Addr *ProxyProtoAddr
+
+	mu      sync.Mutex
+	session *yamux.Session
+	// dialing is closed when the session connecting by one stream is done
+	dialing chan struct{}
+}
+
+// SupportMultiplex mux dialer support multiplex
+func (p *ProxyTunnelMuxDialer) SupportMultiplex() bool {
+	return true
+}
+
+// IsConnectionless mux dialer is connection-oriented
+func (p *ProxyTunnelMuxDialer) IsConnectionless() bool {
+	return false
+}
+
+// SetAddr set a mux ProxyProtoAddr
+func (p *ProxyTunnelMuxDialer) SetAddr(a *ProxyProtoAddr) {
+	p.Addr = a
+}
+
+// GetConn open a stream, same as GetStream
+func (p *ProxyTunnelMuxDialer) GetConn() (net.Conn, error) {
+	return p.GetConnFor(context.Background(), nil)
+}
+
+// GetStream open a stream on the session, reconnect if the session is closed
+func (p *ProxyTunnelMuxDialer) GetStream() (interface{}, error) {
+	return p.GetConnFor(context.Background(), nil)
+}
+
+// GetConnFor open a stream on the session, reconnect until ctx is done if the session is closed
+func (p *ProxyTunnelMuxDialer) GetConnFor(ctx context.Context, client net.Addr) (net.Conn, error) {
+	if p.Addr == nil {
+		return nil, errors.New("not init dailer address")
+	}
+
+	for retry := 0; retry < 2; retry++ {
+		session, err := p.getSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := session.Open()
+		if err == nil {
+			return stream, nil
+		}
+		log.Warnf("open stream on mux session to %s failed: %s", p.Addr.Addr, err)
+		if errors.Is(err, yamux.ErrRemoteGoAway) {
+			// The server is draining, its streams go on until it closes the session
+			p.mu.Lock()
+			if p.session == session {
+				p.session = nil
+			}
+			p.mu.Unlock()
+			continue
+		}
+		// Only a broken session is connected again, streams of others go on
+		// when this one hits the stream limit or a timeout
+		if !errors.Is(err, yamux.ErrSessionShutdown) && !session.IsClosed() {
+			return nil, err
+		}
+	}
+	return nil, errors.New("open stream on mux session failed: " + p.Addr.Addr)
+}
+
+// getSession the open session, or connect one out of lock, other streams wait for it
+func (p *ProxyTunnelMuxDialer) getSession(ctx context.Context) (*yamux.Session, error) {
+	for {
+		p.mu.Lock()
+		if p.session != nil && !p.session.IsClosed() {
+			session := p.session
+			p.mu.Unlock()
+			return session, nil
+		}
+		dialing := p.dialing
+		if dialing == nil {
+			dialing = make(chan struct{})
+			p.dialing = dialing
+			p.mu.Unlock()
+
+			session, err := p.connect(ctx)
+			p.mu.Lock()
+			if err == nil {
+				p.session = session
+			}
+			p.dialing = nil
+			close(dialing)
+			p.mu.Unlock()
+			return session, err
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// connect a new session
+func (p *ProxyTunnelMuxDialer) connect(ctx context.Context) (*yamux.Session, error) {
+	conn, err := dialWithPolicy(ctx, p.Addr, func(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+		return dialSession(ctx, p.Addr, timeout)
+	})
+	if err != nil {
+		return nil, err
+	}
+	session, err := yamux.Client(conn, newMuxConfig(p.Addr))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Infof("mux session opened %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
+	return session, nil
+}
+
+// openStream open a stream of a multiplex dailer, connecting stops when ctx is done
+func openStream(ctx context.Context, dailer ProxyTunnelDialer) (net.Conn, error) {
+	if cd, ok := dailer.(ProxyTunnelClientDialer); ok {
+		return cd.GetConnFor(ctx, nil)
+	}
+	stream, err := dailer.GetStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream.(net.Conn), nil
+}
+
+// Close the session, a new one is connected by next stream
+func (p *ProxyTunnelMuxDialer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.session == nil {
+		return nil
+	}
+	return p.session.Close()
+}
+
+// ProxyTunnelMuxServer accept mux sessions, every stream is a connection
+type ProxyTunnelMuxServer struct {
+	mu       *sync.Mutex
+	sessions *list.List
+}
+
+// NewProxyTunnelMuxServer new MuxServer and set Propreties
+func NewProxyTunnelMuxServer() ProxyTunnelServer {
+	s := new(ProxyTunnelMuxServer)
+	s.mu = new(sync.Mutex)
+	s.sessions = list.New()
+	return s
+}
+
+// Serve a tcp or unix listenner, accept streams of every session
+func (s ProxyTunnelMuxServer) Serve(ctx context.Context, addr *ProxyProtoAddr, wg *sync.WaitGroup) chan *ProxyChainConn {
+	listener, err := listenSession(addr)
+	if err != nil {
+		log.Errorf("create mux listen on %s failed: %s", addr.Addr, err)
+		return nil
+	}
+
+	acl := newAccessList(addr)
+	ch := make(chan *ProxyChainConn)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		log.Infof("start a server listen on %s, waiting to accept session", addr.Addr)
+
+		closeOnDone(ctx, listener)
+
+		var backoff time.Duration
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if acceptStopped(ctx, err, &backoff) {
+					break
+				}
+				continue
+			}
+			backoff = 0
+			if !acl.allowConn(conn) {
+				log.Warnf("refuse a mux session: %s -> %s, denied by acl", conn.RemoteAddr(), conn.LocalAddr())
+				conn.Close()
+				continue
+			}
+
+			session, err := yamux.Server(conn, newMuxConfig(addr))
+			if err != nil {
+				log.Errorf("create mux session from %s failed: %s", conn.RemoteAddr(), err)
+				conn.Close()
+				continue
+			}
+			log.Infof("accept a mux session: %s -> %s", conn.RemoteAddr(), conn.LocalAddr())
+
+			s.mu.Lock()
+			e := s.sessions.PushBack(session)
+			s.mu.Unlock()
+
+			go func() {
+				for {
+					stream, err := session.Accept()
+					if err != nil {
+						break
+					}
+					if !deliver(ctx, ch, &ProxyChainConn{inConn: stream}) {
+						break
+					}
+				}
+				// A session still open at stop is closed after the drain
+				if ctx.Err() != nil && !session.IsClosed() {
+					return
+				}
+				log.Infof("mux session closed: %s -> %s", conn.RemoteAddr(), conn.LocalAddr())
+				s.mu.Lock()
+				s.sessions.Remove(e)
+				s.mu.Unlock()
+			}()
+		}
+
+		// Streams of sessions are drained by the tunnel, no new ones
+		s.mu.Lock()
+		for e := s.sessions.Front(); e != nil; e = e.Next() {
+			e.Value.(*yamux.Session).GoAway()
+		}
+		s.mu.Unlock()
+
+		// After Unix Server Close, Should Remove sock file
+		if addr.IsUnix {
+			if err := os.Remove(addr.UnixAddr.String()); err != nil && !os.IsNotExist(err) {
+				log.Errorf("Remove file: %s, failed: %s", addr.UnixAddr.String(), err)
+			}
+		}
+	}()
+
+	return ch
+}
+
+// CloseSessions close the sessions left after the tunnel is drained
+func (s ProxyTunnelMuxServer) CloseSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for e := s.sessions.Front(); e != nil; e = e.Next() {
+		e.Value.(*yamux.Session).Close()
+	}
+}
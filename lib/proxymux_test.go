@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+func TestMuxDialerSessionOutOfLock(t *testing.T) {
+	refused := freeAddr(t, "tcp")
+	a, err := ResolveAddr("mux+tcp://" + refused + "?retries=3&backoff=10s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &ProxyTunnelMuxDialer{}
+	d.SetAddr(a)
+
+	// The first stream keeps connecting the session in backoff
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := d.GetConnFor(ctx, nil)
+		first <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Another stream stops waiting with its own ctx, and Close is not blocked
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer waitCancel()
+	if _, err := d.GetConnFor(waitCtx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiting stream error %v", err)
+	}
+	d.Close()
+
+	cancel()
+	select {
+	case err := <-first:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("connecting stream error %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connecting the session not stopped by ctx")
+	}
+}
+
+func TestMuxServerDrain(t *testing.T) {
+	echo := startEcho(t)
+	readyAddr := freeAddr(t, "tcp")
+	srv, err := ListenReady(readyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, force := range []bool{false, true} {
+		name := t.Name() + "/completed"
+		drainTimeout := 5 * time.Second
+		if force {
+			name, drainTimeout = t.Name()+"/forced", 300*time.Millisecond
+		}
+		in := "mux+tcp://" + freeAddr(t, "tcp")
+		stop := startTunnel(t, ProxyChainTunnel{Name: name, InAddr: in, OutAddr: "tcp://" + echo.Addr().String(), DrainTimeout: drainTimeout})
+
+		a, _ := ResolveAddr(in)
+		d := &ProxyTunnelMuxDialer{}
+		d.SetAddr(a)
+		defer d.Close()
+		conn, err := d.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		roundTrip(t, conn, "hello")
+
+		stopped := make(chan struct{})
+		start := time.Now()
+		go func() {
+			stop()
+			close(stopped)
+		}()
+		for tunnelState(name) != tunnelDraining {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// Not ready while draining, and the session takes no new streams
+		resp, err := http.Get("http://" + readyAddr + "/ready")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), name+" draining 1") {
+			t.Fatalf("ready %d %q while draining", resp.StatusCode, body)
+		}
+		if stream, err := d.GetConn(); err == nil {
+			stream.SetDeadline(time.Now().Add(time.Second))
+			if _, err := stream.Read(make([]byte, 1)); err == nil {
+				t.Fatal("new stream accepted while draining")
+			}
+			stream.Close()
+		}
+
+		if !force {
+			// The connection completes, then the tunnel stops
+			roundTrip(t, conn, "bye")
+			conn.Close()
+			select {
+			case <-stopped:
+			case <-time.After(2 * time.Second):
+				t.Fatal("tunnel not stopped after the connection completed")
+			}
+			continue
+		}
+
+		// The idle connection is closed at the drain timeout
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("read after drain timeout")
+		}
+		<-stopped
+		if d := time.Since(start); d < drainTimeout {
+			t.Fatalf("closed after %s, before drain timeout", d)
+		}
+	}
+}
+
+func TestMuxDialerReconnect(t *testing.T) {
+	echo := startEcho(t)
+	in := "mux+tcp://" + freeAddr(t, "tcp")
+	a, _ := ResolveAddr(in)
+	d := &ProxyTunnelMuxDialer{}
+	d.SetAddr(a)
+	defer d.Close()
+
+	stop := startTunnel(t, ProxyChainTunnel{Name: t.Name() + "/a", InAddr: in, OutAddr: "tcp://" + echo.Addr().String(), DrainTimeout: 100 * time.Millisecond})
+	first, err := d.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip(t, first, "hello")
+	second, err := d.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if first.(*yamux.Stream).Session() != second.(*yamux.Stream).Session() {
+		t.Fatal("streams on different sessions")
+	}
+
+	// The session closed by the server is connected again
+	stop()
+	startTunnel(t, ProxyChainTunnel{Name: t.Name() + "/b", InAddr: in, OutAddr: "tcp://" + echo.Addr().String()})
+	conn, err := d.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip(t, conn, "again")
+}
@@ -0,0 +1,219 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol v1 and v2 keep the client address through proxies, like:
+//
+//	proxysocket "tcp://0.0.0.0:80?proxy_protocol=v1" "tcp://10.0.0.2:80?proxy_protocol=v2"
+//
+// On outbound, a header of the given version is sent before data,
+// on inbound, a header of v1 or v2 is required and its source is the client address.
+
+const (
+	proxyHeaderTimeout = 10 * time.Second
+	proxyV1MaxLength   = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// checkProxyProtocol check the version of proxy_protocol option
+func checkProxyProtocol(version string) error {
+	if version != "" && version != "v1" && version != "v2" {
+		return errors.New("unsupported proxy_protocol version: " + version)
+	}
+	return nil
+}
+
+// proxyProtoConn a connection with the client address from PROXY protocol header
+type proxyProtoConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+// CloseWrite half-close the connection under
+func (c *proxyProtoConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr the source address of header, or the peer when header has no address
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr the destination address of header, or the local when header has no address
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader read a v1 or v2 header from conn
+func readProxyHeader(conn net.Conn) (*proxyProtoConn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	pc := &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn)}
+	sig, err := pc.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyV2Signature) {
+		pc.remote, pc.local, err = readProxyHeaderV2(pc.r)
+	} else if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		pc.remote, pc.local, err = readProxyHeaderV1(pc.r)
+	} else {
+		err = errors.New("no proxy protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readProxyHeaderV1 PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, nil, errors.New("proxy protocol v1 header too long")
+		}
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, nil, errors.New("invalid proxy protocol v1 header")
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, nil, errors.New("invalid proxy protocol v1 source port")
+	}
+	dport, err := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err != nil {
+		return nil, nil, errors.New("invalid proxy protocol v1 address")
+	}
+	if fields[1] == "TCP4" && (src.To4() == nil || dst.To4() == nil) {
+		return nil, nil, errors.New("invalid proxy protocol v1 ipv4 address")
+	}
+	// An ipv4-mapped address is written in ipv6 form, never as a dotted ipv4 literal
+	if fields[1] == "TCP6" && (!strings.Contains(fields[2], ":") || !strings.Contains(fields[3], ":")) {
+		return nil, nil, errors.New("invalid proxy protocol v1 ipv6 address")
+	}
+	return &net.TCPAddr{IP: src, Port: int(sport)}, &net.TCPAddr{IP: dst, Port: int(dport)}, nil
+}
+
+// readProxyHeaderV2 signature, version and command, family, length, addresses and TLVs
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported proxy protocol version %d", header[12]>>4)
+	}
+	if header[12]&0x0f > 1 {
+		return nil, nil, fmt.Errorf("unsupported proxy protocol v2 command %d", header[12]&0x0f)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL command is sent by proxy itself, keep the peer address
+	if header[12]&0x0f == 0 {
+		return nil, nil, nil
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, nil, errors.New("short proxy protocol v2 ipv4 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))},
+			&net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, nil, errors.New("short proxy protocol v2 ipv6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))},
+			&net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}, nil
+	}
+	return nil, nil, nil
+}
+
+// proxyV1IPv6 the ipv6 form of ip for a TCP6 line, an ipv4 address is mapped
+func proxyV1IPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// writeProxyHeader write a header of version with the client address src and the proxy address dst
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	known := sok && dok
+	ipv4 := known && s.IP.To4() != nil && d.IP.To4() != nil
+
+	var header []byte
+	if version == "v1" {
+		if !known {
+			header = []byte("PROXY UNKNOWN\r\n")
+		} else if ipv4 {
+			header = []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP.To4(), d.IP.To4(), s.Port, d.Port))
+		} else {
+			header = []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", proxyV1IPv6(s.IP), proxyV1IPv6(d.IP), s.Port, d.Port))
+		}
+	} else {
+		header = append([]byte(nil), proxyV2Signature...)
+		if !known {
+			header = append(header, 0x20, 0x00, 0, 0)
+		} else if ipv4 {
+			header = append(header, 0x21, 0x11, 0, 12)
+			header = append(append(header, s.IP.To4()...), d.IP.To4()...)
+		} else {
+			header = append(header, 0x21, 0x21, 0, 36)
+			header = append(append(header, s.IP.To16()...), d.IP.To16()...)
+		}
+		if known {
+			header = append(header, byte(s.Port>>8), byte(s.Port), byte(d.Port>>8), byte(d.Port))
+		}
+	}
+
+	_, err := w.Write(header)
+	return err
+}
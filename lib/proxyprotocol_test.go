@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	unix := &net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"}
+
+	tests := []struct {
+		version  string
+		src, dst net.Addr
+		known    bool
+	}{
+		{"v1", v4src, v4dst, true},
+		{"v1", v6src, v6dst, true},
+		{"v1", v4src, v6dst, true},
+		{"v1", unix, unix, false},
+		{"v2", v4src, v4dst, true},
+		{"v2", v6src, v6dst, true},
+		{"v2", unix, unix, false},
+	}
+	for _, tt := range tests {
+		client, server := tcpPair(t)
+		if err := writeProxyHeader(client, tt.version, tt.src, tt.dst); err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte("data"))
+
+		pc, err := readProxyHeader(server)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.version, tt.src, err)
+		}
+		remote, local := tt.src.String(), tt.dst.String()
+		if !tt.known {
+			remote, local = client.LocalAddr().String(), client.RemoteAddr().String()
+		}
+		if pc.RemoteAddr().String() != remote || pc.LocalAddr().String() != local {
+			t.Errorf("%s %s: got %s -> %s, want %s -> %s", tt.version, tt.src, pc.RemoteAddr(), pc.LocalAddr(), remote, local)
+		}
+		// Data after the header is kept
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(pc, buf); err != nil || string(buf) != "data" {
+			t.Errorf("%s %s: data %q %v", tt.version, tt.src, buf, err)
+		}
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	v2 := func(b ...byte) string { return string(append(append([]byte(nil), proxyV2Signature...), b...)) }
+	tests := []struct {
+		name   string
+		header string
+		err    string
+	}{
+		{"no header", "GET / HTTP/1.1\r\n\r\n", "no proxy protocol header"},
+		{"short", "PROXY", "EOF"},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "too long"},
+		{"v1 no newline", "PROXY TCP4 1.1.1.1 2.2.2.2 1 2", "EOF"},
+		{"v1 fields", "PROXY TCP4 1.1.1.1 2.2.2.2 1\r\n", "invalid proxy protocol v1 header"},
+		{"v1 family", "PROXY UDP4 1.1.1.1 2.2.2.2 1 2\r\n", "invalid proxy protocol v1 header"},
+		{"v1 source port", "PROXY TCP4 1.1.1.1 2.2.2.2 70000 2\r\n", "source port"},
+		{"v1 destination port", "PROXY TCP4 1.1.1.1 2.2.2.2 1 -2\r\n", "invalid proxy protocol v1 address"},
+		{"v1 address", "PROXY TCP4 1.1.1 2.2.2.2 1 2\r\n", "invalid proxy protocol v1 address"},
+		{"v1 ipv6 of TCP4", "PROXY TCP4 ::1 ::1 1 2\r\n", "ipv4 address"},
+		{"v1 ipv4 of TCP6", "PROXY TCP6 1.1.1.1 2.2.2.2 1 2\r\n", "ipv6 address"},
+		{"v1 ipv4 destination of TCP6", "PROXY TCP6 ::1 2.2.2.2 1 2\r\n", "ipv6 address"},
+		{"v2 version", v2(0x11, 0x11, 0, 0), "unsupported proxy protocol version 1"},
+		{"v2 command", v2(0x22, 0x11, 0, 0), "unsupported proxy protocol v2 command 2"},
+		{"v2 short header", v2(0x21, 0x11), "EOF"},
+		{"v2 short body", v2(0x21, 0x11, 0, 12, 1, 2, 3), "EOF"},
+		{"v2 short ipv4", v2(0x21, 0x11, 0, 4, 1, 2, 3, 4), "short proxy protocol v2 ipv4 address"},
+		{"v2 short ipv6", v2(0x21, 0x21, 0, 12, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12), "short proxy protocol v2 ipv6 address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			client.Write([]byte(tt.header))
+			client.(*net.TCPConn).CloseWrite()
+			pc, err := readProxyHeader(server)
+			if pc != nil || err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("read %q: %v %v, want error %q", tt.header, pc, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderV2Local(t *testing.T) {
+	client, server := tcpPair(t)
+	// LOCAL with a TLV, the address of peer is kept
+	header := append(append([]byte(nil), proxyV2Signature...), 0x20, 0x11, 0, 15)
+	header = append(header, 1, 2, 3, 4, 5, 6, 7, 8, 0, 1, 0, 2, 0x04, 0, 0)
+	client.Write(append(header, "data"...))
+
+	pc, err := readProxyHeader(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Fatalf("remote %s, want %s", pc.RemoteAddr(), client.LocalAddr())
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(pc, buf); err != nil || string(buf) != "data" {
+		t.Fatalf("data %q %v", buf, err)
+	}
+}
+
+func TestProxyProtocolTunnel(t *testing.T) {
+	// The upstream reads the header of v1 and echoes the line
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		io.WriteString(conn, line)
+	}()
+
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{
+		InAddr:  "tcp://" + in + "?proxy_protocol=v2",
+		OutAddr: "tcp://" + upstream.Addr().String() + "?proxy_protocol=v1",
+	})
+
+	conn, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	writeProxyHeader(conn, "v2", src, dst)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "PROXY TCP4 203.0.113.7 198.51.100.1 40000 443\r\n"; line != want {
+		t.Fatalf("upstream got %q, want %q", line, want)
+	}
+}
@@ -0,0 +1,416 @@
+package lib
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Reverse tunnel, an agent behind NAT dials out to a server and registers a name,
+// connections accepted by the server are relayed back to the agent's local service:
+//
+//	server: proxysocket tcp://0.0.0.0:2222 "reverse+tcp://0.0.0.0:7000?name=ssh&token=secret"
+//	agent:  proxysocket "agent+tcp://server:7000?name=ssh&token=secret" tcp://127.0.0.1:22
+//
+// Many names can share one reverse address, every name has one agent at a time,
+// a new agent of the same name replaces the old one.
+//
+// The token is sent in clear text on reverse+tcp and agent+tcp, only use them on a trusted
+// link, reverse+tls and agent+tls carry the registration and the session in tls.
+
+const (
+	reverseRegister  = "REGISTER"
+	reverseAccepted  = "OK"
+	reverseRejected  = "ERR"
+	reverseHandshake = 10 * time.Second
+
+	// reverseMaxHandshakes registrations read at the same time, more agents are refused
+	reverseMaxHandshakes = 64
+
+	agentMinBackoff = time.Second
+	agentMaxBackoff = 30 * time.Second
+)
+
+// checkReverseOptions name and token of reverse and agent address are words of the registration line
+func checkReverseOptions(pa *ProxyProtoAddr) error {
+	if !pa.IsReverse && !pa.IsAgent {
+		return nil
+	}
+	for _, option := range []string{"name", "token"} {
+		if v := pa.Options.Get(option); v != strings.Join(strings.Fields(v), "") {
+			return errors.New(option + " should not contain spaces")
+		}
+	}
+	return nil
+}
+
+// readLine read a handshake line without buffering, data after it belongs to the session
+func readLine(conn net.Conn) (string, error) {
+	line := make([]byte, 0, 64)
+	b := make([]byte, 1)
+	for len(line) < 1024 {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("handshake line too long")
+}
+
+// reverseListener accept agents on one address
+type reverseListener struct {
+	addr     *ProxyProtoAddr
+	key      string
+	listener net.Listener
+
+	// handshakes registrations being read, bounded by reverseMaxHandshakes
+	handshakes chan struct{}
+
+	mu     sync.Mutex
+	tokens map[string]string
+	agents map[string]*yamux.Session
+}
+
+var reverseListeners = struct {
+	mu        sync.Mutex
+	listeners map[string]*reverseListener
+}{listeners: make(map[string]*reverseListener)}
+
+// ListenReverse listen for agents of the reverse address until ctx is done, it is called before serving
+func ListenReverse(ctx context.Context, addr *ProxyProtoAddr) error {
+	if !addr.IsReverse {
+		return errors.New("not a reverse address: " + addr.Addr)
+	}
+	name := addr.Options.Get("name")
+	if name == "" {
+		return errors.New("reverse address needs a name: " + addr.Addr)
+	}
+
+	network, address := muxNetAddr(addr)
+	key := network + "://" + address
+
+	reverseListeners.mu.Lock()
+	defer reverseListeners.mu.Unlock()
+
+	l, ok := reverseListeners.listeners[key]
+	if !ok {
+		listener, err := listenSession(addr)
+		if err != nil {
+			return err
+		}
+		l = &reverseListener{
+			addr:       addr,
+			key:        key,
+			listener:   listener,
+			handshakes: make(chan struct{}, reverseMaxHandshakes),
+			tokens:     make(map[string]string),
+			agents:     make(map[string]*yamux.Session),
+		}
+		reverseListeners.listeners[key] = l
+		go l.serve()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.tokens[name]; ok {
+		return errors.New("reverse name is registered: " + name)
+	}
+	l.tokens[name] = addr.Options.Get("token")
+	context.AfterFunc(ctx, func() { l.unregister(name) })
+	return nil
+}
+
+// unregister the name and close its agent, the listener is closed after the last name
+func (l *reverseListener) unregister(name string) {
+	reverseListeners.mu.Lock()
+	defer reverseListeners.mu.Unlock()
+
+	l.mu.Lock()
+	delete(l.tokens, name)
+	if session, ok := l.agents[name]; ok {
+		session.Close()
+		delete(l.agents, name)
+	}
+	empty := len(l.tokens) == 0
+	l.mu.Unlock()
+
+	if empty {
+		delete(reverseListeners.listeners, l.key)
+		l.listener.Close()
+	}
+}
+
+// getReverseListener find listener of a reverse address
+func getReverseListener(addr *ProxyProtoAddr) *reverseListener {
+	network, address := muxNetAddr(addr)
+	reverseListeners.mu.Lock()
+	defer reverseListeners.mu.Unlock()
+	return reverseListeners.listeners[network+"://"+address]
+}
+
+// serve accept agents until the listener is closed by unregistering the last name
+func (l *reverseListener) serve() {
+	log.Infof("start a reverse server listen on %s, waiting to accept agent", l.addr.Addr)
+
+	var backoff time.Duration
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if acceptStopped(context.Background(), err, &backoff) {
+				break
+			}
+			continue
+		}
+		backoff = 0
+		select {
+		case l.handshakes <- struct{}{}:
+			go l.register(conn)
+		default:
+			log.Warnf("refuse agent %s: %d registrations in progress", conn.RemoteAddr(), reverseMaxHandshakes)
+			conn.Close()
+		}
+	}
+	log.Infof("stop the reverse server listen on %s", l.addr.Addr)
+
+	l.mu.Lock()
+	for _, session := range l.agents {
+		session.Close()
+	}
+	l.mu.Unlock()
+}
+
+// register check the registration of an agent, then open a session on it
+func (l *reverseListener) register(conn net.Conn) {
+	name, ok := l.handshake(conn)
+	<-l.handshakes
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	session, err := yamux.Client(conn, newMuxConfig(l.addr))
+	if err != nil {
+		log.Errorf("create session to agent %s failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	l.mu.Lock()
+	if old, ok := l.agents[name]; ok {
+		old.Close()
+	}
+	l.agents[name] = session
+	l.mu.Unlock()
+	log.Infof("agent %s registered: %s -> %s", name, conn.RemoteAddr(), conn.LocalAddr())
+
+	<-session.CloseChan()
+
+	l.mu.Lock()
+	if l.agents[name] == session {
+		delete(l.agents, name)
+	}
+	l.mu.Unlock()
+	log.Infof("agent %s closed: %s -> %s", name, conn.RemoteAddr(), conn.LocalAddr())
+}
+
+// handshake read the registration line in time, the name if the token is accepted
+func (l *reverseListener) handshake(conn net.Conn) (string, bool) {
+	conn.SetDeadline(time.Now().Add(reverseHandshake))
+	line, err := readLine(conn)
+	if err != nil {
+		log.Errorf("read registration of agent %s failed: %s", conn.RemoteAddr(), err)
+		return "", false
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 || fields[0] != reverseRegister {
+		log.Errorf("invalid registration of agent %s", conn.RemoteAddr())
+		fmt.Fprintf(conn, "%s invalid registration\n", reverseRejected)
+		return "", false
+	}
+	name, token := fields[1], ""
+	if len(fields) > 2 {
+		token = fields[2]
+	}
+
+	l.mu.Lock()
+	expected, ok := l.tokens[name]
+	l.mu.Unlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(token)) != 1 {
+		log.Errorf("reject agent %s of name %s", conn.RemoteAddr(), name)
+		fmt.Fprintf(conn, "%s unknown name or token\n", reverseRejected)
+		return "", false
+	}
+
+	if _, err := fmt.Fprintf(conn, "%s\n", reverseAccepted); err != nil {
+		return "", false
+	}
+	conn.SetDeadline(time.Time{})
+	return name, true
+}
+
+// ProxyTunnelReverseDialer open streams on the session of a registered agent
+type ProxyTunnelReverseDialer struct {
+	Addr *ProxyProtoAddr
+}
+
+// SupportMultiplex reverse dialer support multiplex
+func (p *ProxyTunnelReverseDialer) SupportMultiplex() bool {
+	return true
+}
+
+// IsConnectionless reverse dialer is connection-oriented
+func (p *ProxyTunnelReverseDialer) IsConnectionless() bool {
+	return false
+}
+
+// SetAddr set a reverse ProxyProtoAddr
+func (p *ProxyTunnelReverseDialer) SetAddr(a *ProxyProtoAddr) {
+	p.Addr = a
+}
+
+// GetConn open a stream, same as GetStream
+func (p *ProxyTunnelReverseDialer) GetConn() (net.Conn, error) {
+	stream, err := p.GetStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream.(net.Conn), nil
+}
+
+// GetStream open a stream to the agent
+func (p *ProxyTunnelReverseDialer) GetStream() (interface{}, error) {
+	if p.Addr == nil {
+		return nil, errors.New("not init dailer address")
+	}
+	l := getReverseListener(p.Addr)
+	if l == nil {
+		return nil, errors.New("not listen on reverse address: " + p.Addr.Addr)
+	}
+
+	name := p.Addr.Options.Get("name")
+	l.mu.Lock()
+	session := l.agents[name]
+	l.mu.Unlock()
+	if session == nil {
+		return nil, errors.New("no agent registered of name: " + name)
+	}
+	return session.Open()
+}
+
+// ProxyTunnelAgentServer dial out to a reverse server, every stream from it is a connection
+type ProxyTunnelAgentServer struct {
+	mu sync.Mutex
+	// session left at stop, closed after the drain
+	session *yamux.Session
+}
+
+// Serve keep a session to the reverse server, reconnect with backoff when it is closed
+func (s *ProxyTunnelAgentServer) Serve(ctx context.Context, addr *ProxyProtoAddr, wg *sync.WaitGroup) chan *ProxyChainConn {
+	name := addr.Options.Get("name")
+	if name == "" {
+		log.Errorf("agent address needs a name: %s", addr.Addr)
+		return nil
+	}
+
+	ch := make(chan *ProxyChainConn)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		backoff := agentMinBackoff
+	ConnectLoop:
+		for {
+			session, err := s.connect(ctx, addr, name)
+			if err != nil {
+				log.Errorf("agent %s connect %s failed: %s, retry after %s", name, addr.Addr, err, backoff)
+				select {
+				case <-ctx.Done():
+					break ConnectLoop
+				case <-time.After(backoff):
+				}
+				if backoff *= 2; backoff > agentMaxBackoff {
+					backoff = agentMaxBackoff
+				}
+				continue
+			}
+			backoff = agentMinBackoff
+
+			go func() {
+				for {
+					stream, err := session.Accept()
+					if err != nil {
+						break
+					}
+					if !deliver(ctx, ch, &ProxyChainConn{inConn: stream}) {
+						break
+					}
+				}
+			}()
+
+			select {
+			case <-ctx.Done():
+				// Streams of the session are drained by the tunnel, no new ones
+				session.GoAway()
+				s.mu.Lock()
+				s.session = session
+				s.mu.Unlock()
+				break ConnectLoop
+			case <-session.CloseChan():
+				log.Warnf("agent %s session to %s closed", name, addr.Addr)
+			}
+		}
+	}()
+
+	return ch
+}
+
+// CloseSessions close the session left after the tunnel is drained
+func (s *ProxyTunnelAgentServer) CloseSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session != nil {
+		s.session.Close()
+		s.session = nil
+	}
+}
+
+// connect dial to the reverse server and register the name
+func (s *ProxyTunnelAgentServer) connect(ctx context.Context, addr *ProxyProtoAddr, name string) (*yamux.Session, error) {
+	conn, err := dialSession(ctx, addr, reverseHandshake)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(reverseHandshake))
+	fmt.Fprintf(conn, "%s %s %s\n", reverseRegister, name, addr.Options.Get("token"))
+	line, err := readLine(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if strings.TrimSpace(line) != reverseAccepted {
+		conn.Close()
+		return nil, errors.New("registration rejected: " + strings.TrimSpace(line))
+	}
+	conn.SetDeadline(time.Time{})
+
+	session, err := yamux.Server(conn, newMuxConfig(addr))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Infof("agent %s registered: %s -> %s", name, conn.LocalAddr(), conn.RemoteAddr())
+	return session, nil
+}
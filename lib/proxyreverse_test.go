@@ -0,0 +1,284 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// listenReverse listen for agents of the reverse address until the test ends, the returned
+// cancel unregisters the name
+func listenReverse(t *testing.T, address string) (*ProxyProtoAddr, context.CancelFunc) {
+	t.Helper()
+	a, err := ResolveAddr(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := ListenReverse(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	return a, cancel
+}
+
+// registerRaw send a registration line, the connection and the reply
+func registerRaw(t *testing.T, addr, line string) (net.Conn, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, line+"\n")
+	reply, err := readLine(conn)
+	if err != nil {
+		t.Fatalf("%s: %v", line, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reply
+}
+
+func TestReverseRegister(t *testing.T) {
+	addr := freeAddr(t, "tcp")
+	listenReverse(t, "reverse+tcp://"+addr+"?name=ssh&token=secret")
+	listenReverse(t, "reverse+tcp://"+addr+"?name=web")
+
+	tests := []struct {
+		line  string
+		reply string
+	}{
+		{"REGISTER ssh secret", "OK"},
+		{"REGISTER web", "OK"},
+		{"REGISTER ssh wrong", "ERR unknown name or token"},
+		{"REGISTER ssh", "ERR unknown name or token"},
+		{"REGISTER db secret", "ERR unknown name or token"},
+		{"HELLO ssh secret", "ERR invalid registration"},
+		{"REGISTER ssh secret more", "ERR invalid registration"},
+	}
+	for _, tt := range tests {
+		if _, reply := registerRaw(t, addr, tt.line); reply != tt.reply {
+			t.Errorf("%s: reply %q, want %q", tt.line, reply, tt.reply)
+		}
+	}
+
+	// A name of one address is registered once
+	a, _ := ResolveAddr("reverse+tcp://" + addr + "?name=ssh")
+	if err := ListenReverse(context.Background(), a); err == nil {
+		t.Fatal("name registered twice")
+	}
+	for _, address := range []string{"reverse+tcp://" + addr + "?name=ssh&token=a%20b", "agent+tcp://" + addr + "?name=a%09b"} {
+		if _, err := ResolveAddr(address); err == nil || !strings.Contains(err.Error(), "should not contain spaces") {
+			t.Errorf("%s: error %v", address, err)
+		}
+	}
+}
+
+func TestReverseDialer(t *testing.T) {
+	addr := freeAddr(t, "tcp")
+	a, _ := listenReverse(t, "reverse+tcp://"+addr+"?name=echo&token=secret")
+	d := &ProxyTunnelReverseDialer{}
+	d.SetAddr(a)
+	if _, err := d.GetConn(); err == nil || !strings.Contains(err.Error(), "no agent registered") {
+		t.Fatalf("stream without agent: %v", err)
+	}
+
+	// agent accept streams of the session on conn and echo them
+	agent := func(conn net.Conn) *yamux.Session {
+		session, err := yamux.Server(conn, newMuxConfig(a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				stream, err := session.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					io.Copy(stream, stream)
+				}()
+			}
+		}()
+		return session
+	}
+
+	first, reply := registerRaw(t, addr, "REGISTER echo secret")
+	if reply != "OK" {
+		t.Fatal(reply)
+	}
+	firstSession := agent(first)
+	conn := waitReverseStream(t, d)
+	roundTrip(t, conn, "hello")
+	conn.Close()
+
+	// A new agent of the same name replaces the old one
+	second, reply := registerRaw(t, addr, "REGISTER echo secret")
+	if reply != "OK" {
+		t.Fatal(reply)
+	}
+	secondSession := agent(second)
+	select {
+	case <-firstSession.CloseChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("old agent not closed")
+	}
+	conn = waitReverseStream(t, d)
+	defer conn.Close()
+	roundTrip(t, conn, "again")
+	if secondSession.NumStreams() != 1 {
+		t.Fatalf("%d streams on the new agent", secondSession.NumStreams())
+	}
+}
+
+// waitReverseStream open a stream once the agent session is registered
+func waitReverseStream(t *testing.T, d *ProxyTunnelReverseDialer) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := d.GetConn()
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReverseTunnel(t *testing.T) {
+	echo := startEcho(t)
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	cert, key := ca.leaf("server", "reverse.test")
+
+	tests := []struct {
+		reverse string
+		agent   string
+	}{
+		{"reverse+tcp://%s?name=echo&token=secret", "agent+tcp://%s?name=echo&token=secret"},
+		{"reverse+tls://%s?name=echo&token=secret&cert=" + cert + "&key=" + key, "agent+tls://%s?name=echo&token=secret&ca=" + ca.file + "&servername=reverse.test"},
+	}
+	for i, tt := range tests {
+		rev := freeAddr(t, "tcp")
+		in := freeAddr(t, "tcp")
+		startTunnel(t, ProxyChainTunnel{
+			Name:    fmt.Sprintf("%s/server%d", t.Name(), i),
+			InAddr:  "tcp://" + in,
+			OutAddr: fmt.Sprintf(tt.reverse, rev),
+		})
+		startTunnel(t, ProxyChainTunnel{
+			Name:    fmt.Sprintf("%s/agent%d", t.Name(), i),
+			InAddr:  fmt.Sprintf(tt.agent, rev),
+			OutAddr: "tcp://" + echo.Addr().String(),
+		})
+
+		// The agent registers after the tunnel serves
+		a, _ := ResolveAddr(fmt.Sprintf(tt.reverse, rev))
+		d := &ProxyTunnelReverseDialer{}
+		d.SetAddr(a)
+		waitReverseStream(t, d).Close()
+
+		conn, err := net.Dial("tcp", in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		roundTrip(t, conn, "hello")
+		conn.Close()
+
+		// The registration of tls is not readable in plaintext
+		if strings.HasPrefix(tt.reverse, "reverse+tls") {
+			raw, err := net.Dial("tcp", rev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(raw, "REGISTER echo secret\n")
+			if reply, err := readLine(raw); err == nil && reply == "OK" {
+				t.Fatal("plaintext registration accepted by tls")
+			}
+			raw.Close()
+		}
+	}
+}
+
+func TestReverseHandshakeLimit(t *testing.T) {
+	addr := freeAddr(t, "tcp")
+	listenReverse(t, "reverse+tcp://"+addr+"?name=ssh&token=secret")
+
+	// Connections never sending a registration hold every handshake
+	for i := 0; i < reverseMaxHandshakes; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "REGISTER ssh secret\n")
+	if reply, err := readLine(conn); err == nil {
+		t.Fatalf("registration over the limit replied %q", reply)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("registration over the limit not closed")
+	}
+}
+
+func TestReverseUnregister(t *testing.T) {
+	addr := freeAddr(t, "tcp")
+	a, cancelSSH := listenReverse(t, "reverse+tcp://"+addr+"?name=ssh")
+	_, cancelWeb := listenReverse(t, "reverse+tcp://"+addr+"?name=web")
+	agent, reply := registerRaw(t, addr, "REGISTER ssh")
+	if reply != "OK" {
+		t.Fatal(reply)
+	}
+	session, err := yamux.Server(agent, newMuxConfig(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The agent of the name is closed, the listener serves the other name
+	cancelSSH()
+	select {
+	case <-session.CloseChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("agent of unregistered name not closed")
+	}
+	if _, reply := registerRaw(t, addr, "REGISTER ssh"); reply != "ERR unknown name or token" {
+		t.Fatalf("unregistered name replied %q", reply)
+	}
+	if getReverseListener(a) == nil {
+		t.Fatal("listener closed with a name left")
+	}
+
+	// The listener is closed after the last name
+	cancelWeb()
+	deadline := time.Now().Add(2 * time.Second)
+	for getReverseListener(a) != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if getReverseListener(a) != nil {
+		t.Fatal("listener kept after the last name")
+	}
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("listener still accepting")
+	}
+}
@@ -1,39 +1,47 @@
 package lib
 
 import (
-	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
 
 	"net"
 	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 	"time"
 )
 
 // ProxyTunnelServer abstract of different proto server
 type ProxyTunnelServer interface {
-	// Listen on addr, tel main goruntine when finish by wg
-	Serve(addr *ProxyProtoAddr, wg *sync.WaitGroup) chan *ProxyChainConn
+	// Listen on addr until ctx is done, tel main goruntine when finish by wg
+	Serve(ctx context.Context, addr *ProxyProtoAddr, wg *sync.WaitGroup) chan *ProxyChainConn
+}
+
+// ProxyTunnelSessionServer a server of mux sessions, they refuse new streams when ctx is done
+// and are closed by the tunnel after its connections are drained
+type ProxyTunnelSessionServer interface {
+	CloseSessions()
 }
 
 // ProxyTunnelTCPServer a tcp tunnel server
 type ProxyTunnelTCPServer struct {
-	mu    *sync.Mutex
-	conns *list.List
+	// handshake negotiate with client before proxy, it runs out of accept loop,
+	// may send connections to ch itself and return nil
+	handshake func(ctx context.Context, conn net.Conn, ch chan<- *ProxyChainConn) (*ProxyChainConn, error)
+	// limiter refuse a connection over max_conns before negotiating
+	limiter *connLimiter
 }
 
 // NewProxyTunnelTCPServer new TCPServer and set Propreties
 func NewProxyTunnelTCPServer() ProxyTunnelServer {
-	s := new(ProxyTunnelTCPServer)
-	s.mu = new(sync.Mutex)
-	s.conns = list.New()
-	return s
+	return new(ProxyTunnelTCPServer)
 }
 
 // ProxyTunnelUDPServer a udp tunnel server
 type ProxyTunnelUDPServer struct {
 	Addr *net.UDPAddr
+
+	datagrams *datagramLimit
 }
 
 // ProxyTunnelUnixServer a unix tunnel server
@@ -41,14 +49,76 @@ type ProxyTunnelUnixServer struct {
 	Addr *net.UnixAddr
 }
 
+// deliver send a connection to the tunnel, it is closed if the tunnel is stopped
+func deliver(ctx context.Context, ch chan<- *ProxyChainConn, c *ProxyChainConn) bool {
+	select {
+	case ch <- c:
+		return true
+	case <-ctx.Done():
+		c.Close()
+		return false
+	}
+}
+
+// closeOnDone close the listener when ctx is done, so a blocking accept returns
+func closeOnDone(ctx context.Context, listener interface{ Close() error }) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+}
+
+// Backoff of temporary accept errors, like too many open files
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// acceptStopped the accept loop should stop, the listener is closed or a fatal error.
+// A temporary error waits backoff doubled every time, reset it to zero after an accept.
+func acceptStopped(ctx context.Context, err error, backoff *time.Duration) bool {
+	if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	if opErr, ok := err.(net.Error); ok && opErr.Temporary() {
+		if *backoff *= 2; *backoff < minAcceptBackoff {
+			*backoff = minAcceptBackoff
+		} else if *backoff > maxAcceptBackoff {
+			*backoff = maxAcceptBackoff
+		}
+		log.Warnf("accept failed: %s, retry after %s", err, *backoff)
+		timer := time.NewTimer(*backoff)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return true
+		}
+	}
+	log.Error(err)
+	return true
+}
+
 // Serve a tcp listenner
-func (s ProxyTunnelTCPServer) Serve(addr *ProxyProtoAddr, wg *sync.WaitGroup) chan *ProxyChainConn {
-	listener, err := net.ListenTCP(addr.TCPAddr.Network(), addr.TCPAddr)
+func (s ProxyTunnelTCPServer) Serve(ctx context.Context, addr *ProxyProtoAddr, wg *sync.WaitGroup) chan *ProxyChainConn {
+	if addr.IsTLS && (addr.TLSConfig == nil || len(addr.TLSConfig.Certificates) == 0) {
+		log.Errorf("create tls listen on %s failed: no cert and key given", addr.Addr)
+		return nil
+	}
+
+	la, err := net.ResolveTCPAddr(addrNetwork(addr), addr.Host)
+	if err != nil {
+		log.Errorf("resolve tcp listen address %s failed: %s", addr.Addr, err)
+		return nil
+	}
+	listener, err := net.ListenTCP(la.Network(), la)
 	if err != nil {
 		log.Errorf("create tcp socket listen on %s failed: %s", addr.Addr, err)
 		return nil
 	}
 
+	acl := newAccessList(addr)
 	ch := make(chan *ProxyChainConn)
 
 	wg.Add(1)
@@ -56,70 +126,111 @@ func (s ProxyTunnelTCPServer) Serve(addr *ProxyProtoAddr, wg *sync.WaitGroup) ch
 		defer wg.Done()
 
 		log.Infof("start a server listen on %s, waiting to accept connection", addr.Addr)
+		closeOnDone(ctx, listener)
 
-		quitC := make(chan os.Signal, 1)
-		signal.Notify(quitC, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
-		timeoutCount := 0
-	AcceptLoop:
+		var backoff time.Duration
 		for {
-			select {
-			case <-quitC:
-				listener.Close()
-				s.mu.Lock()
-				for e := s.conns.Front(); e != nil; e = e.Next() {
-					c := e.Value.(*ProxyChainConn)
-					c.Close()
-				}
-				s.mu.Unlock()
-				break AcceptLoop
-			default:
-			}
-			listener.SetDeadline(time.Now().Add(1 * time.Second))
 			conn, err := listener.Accept()
 			if err != nil {
-				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-					timeoutCount++
-					if timeoutCount < 3 {
-						continue
-					} else {
-						s.mu.Lock()
-						for e := s.conns.Front(); e != nil; e = e.Next() {
-							c := e.Value.(*ProxyChainConn)
-							if c.IsClosed {
-								s.conns.Remove(e)
-							}
-						}
-						s.mu.Unlock()
-					}
-				} else {
-					log.Error(err)
+				if acceptStopped(ctx, err, &backoff) {
+					break
 				}
-			} else {
-				timeoutCount = 0
-				log.Infof("accept a connection: %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
-				c := &ProxyChainConn{inConn: conn}
-				ch <- c
-				s.mu.Lock()
-				s.conns.PushBack(c)
-				s.mu.Unlock()
+				continue
+			}
+			backoff = 0
+			log.Infof("accept a connection: %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
+			if addr.Options.Get("proxy_protocol") == "" && !acl.allowConn(conn) {
+				log.Warnf("refuse a connection: %s -> %s, denied by acl", conn.RemoteAddr(), conn.LocalAddr())
+				conn.Close()
+				continue
+			}
+			// The header is only trusted from the proxies allowed
+			if addr.Options.Get("proxy_protocol") != "" && !acl.allowProxy(conn) {
+				log.Warnf("refuse a connection: %s -> %s, not an allowed proxy", conn.RemoteAddr(), conn.LocalAddr())
+				conn.Close()
+				continue
+			}
+			if s.handshake != nil || addr.Options.Get("proxy_protocol") != "" {
+				if err := s.limiter.acceptable(); err != nil {
+					log.Warnf("refuse a connection: %s -> %s, %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+					conn.Close()
+					continue
+				}
+				// Reading from client should not block to accept
+				go s.negotiate(ctx, conn, addr, acl, ch)
+				continue
 			}
+			if addr.IsTLS {
+				// Handshake is done later in Exchange, not block to accept
+				conn = tls.Server(conn, addr.TLSConfig)
+			}
+			deliver(ctx, ch, &ProxyChainConn{inConn: conn})
 		}
-
+		log.Infof("stop the server listen on %s", addr.Addr)
 	}()
 
 	return ch
 
 }
 
+// negotiate read PROXY protocol header and handshake with client, then send the connection to ch
+func (s ProxyTunnelTCPServer) negotiate(ctx context.Context, conn net.Conn, addr *ProxyProtoAddr, acl *accessList, ch chan<- *ProxyChainConn) {
+	if addr.Options.Get("proxy_protocol") != "" {
+		pc, err := readProxyHeader(conn)
+		if err != nil {
+			log.Errorf("read proxy protocol header from %s failed: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		log.Infof("proxy protocol client address: %s -> %s", pc.RemoteAddr(), conn.RemoteAddr())
+		// The client in header is checked, not the proxy
+		if !acl.allowConn(pc) {
+			log.Warnf("refuse a connection: %s -> %s, denied by acl", pc.RemoteAddr(), conn.LocalAddr())
+			conn.Close()
+			return
+		}
+		conn = pc
+	}
+
+	if addr.IsTLS {
+		conn = tls.Server(conn, addr.TLSConfig)
+	}
+
+	c := &ProxyChainConn{inConn: conn}
+	if s.handshake != nil {
+		var err error
+		if c, err = s.handshake(ctx, conn, ch); err != nil {
+			log.Errorf("handshake with %s failed: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		if c == nil {
+			return
+		}
+	}
+
+	deliver(ctx, ch, c)
+}
+
 // Serve a udp listenner
-func (s ProxyTunnelUDPServer) Serve(addr *ProxyProtoAddr, wg *sync.WaitGroup) chan *ProxyChainConn {
-	conn, err := net.ListenUDP(addr.UDPAddr.Network(), addr.UDPAddr)
+func (s ProxyTunnelUDPServer) Serve(ctx context.Context, addr *ProxyProtoAddr, wg *sync.WaitGroup) chan *ProxyChainConn {
+	la, err := net.ResolveUDPAddr(addrNetwork(addr), addr.Host)
+	if err != nil {
+		log.Errorf("resolve udp listen address %s failed: %s", addr.Addr, err)
+		return nil
+	}
+	conn, err := net.ListenUDP(la.Network(), la)
 	if err != nil {
 		log.Errorf("create udp socket listen on %s failed: %s", addr.Addr, err)
 		return nil
 	}
 
+	datagrams := s.datagrams
+	if datagrams == nil {
+		datagrams = newDatagramLimit(addr.Addr, defaultMaxDatagram)
+	}
+	acl := newAccessList(addr)
+
 	ch := make(chan *ProxyChainConn)
 
 	wg.Add(1)
@@ -127,32 +238,28 @@ func (s ProxyTunnelUDPServer) Serve(addr *ProxyProtoAddr, wg *sync.WaitGroup) ch
 		defer wg.Done()
 
 		log.Infof("start a server listen on %s, waiting to accept connection", addr.Addr)
+		closeOnDone(ctx, conn)
 
-		quitC := make(chan os.Signal, 1)
-		signal.Notify(quitC, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
-	ConnLoop:
+		var backoff time.Duration
 		for {
-			select {
-			case <-quitC:
-				conn.Close()
-				break ConnLoop
-			default:
-			}
-
-			buf := make([]byte, 1500) // 1500 is Max UDP Packet Size
-
-			conn.SetDeadline(time.Now().Add(3 * time.Second))
-			size, remoteAddr, err := conn.ReadFromUDP(buf)
-
+			buf := datagrams.buffer()
+			size, remoteAddr, err := conn.ReadFromUDP(*buf)
 			if err != nil {
-				if opErr, ok := err.(*net.OpError); ok && !opErr.Timeout() {
-					log.Error(err)
-					// What should todo here?
+				datagrams.release(buf)
+				if acceptStopped(ctx, err, &backoff) {
+					break
 				}
+				continue
 			}
+			backoff = 0
 
-			if size == 0 {
+			if size == 0 || datagrams.isTruncated(size, remoteAddr) {
+				datagrams.release(buf)
+				continue
+			}
+			if !acl.allowAddr(remoteAddr) {
+				log.Warnf("drop udp %d bytes from %s on %s, denied by acl", size, remoteAddr, conn.LocalAddr())
+				datagrams.release(buf)
 				continue
 			}
 
@@ -161,10 +268,15 @@ func (s ProxyTunnelUDPServer) Serve(addr *ProxyProtoAddr, wg *sync.WaitGroup) ch
 			c := &ProxyChainConn{
 				inConn:          conn,
 				InUDPRemoteAddr: remoteAddr,
-				UDPData:         buf[:size],
+				UDPData:         (*buf)[:size],
+				datagrams:       datagrams,
+				udpBuf:          buf,
+			}
+			if !deliver(ctx, ch, c) {
+				break
 			}
-			ch <- c
 		}
+		log.Infof("stop the server listen on %s", addr.Addr)
 	}()
 
 	return ch
@@ -172,13 +284,14 @@ func (s ProxyTunnelUDPServer) Serve(addr *ProxyProtoAddr, wg *sync.WaitGroup) ch
 }
 
 // Serve a unix listenner
-func (s ProxyTunnelUnixServer) Serve(addr *ProxyProtoAddr, wg *sync.WaitGroup) chan *ProxyChainConn {
+func (s ProxyTunnelUnixServer) Serve(ctx context.Context, addr *ProxyProtoAddr, wg *sync.WaitGroup) chan *ProxyChainConn {
 	listener, err := net.ListenUnix(addr.UnixAddr.Network(), addr.UnixAddr)
 	if err != nil {
 		log.Errorf("create unix socket listen on %s failed: %s", addr.Addr, err)
 		return nil
 	}
 
+	acl := newAccessList(addr)
 	ch := make(chan *ProxyChainConn)
 	wg.Add(1)
 
@@ -186,35 +299,30 @@ func (s ProxyTunnelUnixServer) Serve(addr *ProxyProtoAddr, wg *sync.WaitGroup) c
 		defer wg.Done()
 
 		log.Infof("start a server listen on %s, waiting to accept connection", addr.Addr)
+		closeOnDone(ctx, listener)
 
-		quitC := make(chan os.Signal, 1)
-		signal.Notify(quitC, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
-	AcceptLoop:
+		var backoff time.Duration
 		for {
-			select {
-			case <-quitC:
-				listener.Close()
-				break AcceptLoop
-			default:
-			}
-
-			listener.SetDeadline(time.Now().Add(1 * time.Second))
 			conn, err := listener.Accept()
 			if err != nil {
-				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-					continue
+				if acceptStopped(ctx, err, &backoff) {
+					break
 				}
-				log.Error(err)
-			} else {
-				log.Infof("accept a connection: %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
-				c := &ProxyChainConn{inConn: conn}
-				ch <- c
+				continue
+			}
+			backoff = 0
+			log.Infof("accept a connection: %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
+			if !acl.allowConn(conn) {
+				log.Warnf("refuse a connection on %s, denied by acl", conn.LocalAddr())
+				conn.Close()
+				continue
 			}
+			deliver(ctx, ch, &ProxyChainConn{inConn: conn})
 		}
+		log.Infof("stop the server listen on %s", addr.Addr)
 
 		// After Unix Server Close, Should Remove sock file
-		if err := os.Remove(addr.UnixAddr.String()); !os.IsNotExist(err) {
+		if err := os.Remove(addr.UnixAddr.String()); err != nil && !os.IsNotExist(err) {
 			log.Errorf("Remove file: %s, failed: %s", addr.UnixAddr.String(), err)
 		}
 
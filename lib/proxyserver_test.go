@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempError a temporary accept error, like too many open files
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+func TestAcceptStoppedBackoff(t *testing.T) {
+	ctx := context.Background()
+	var backoff time.Duration
+	for _, want := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond} {
+		start := time.Now()
+		if acceptStopped(ctx, tempError{}, &backoff) {
+			t.Fatal("stopped by a temporary error")
+		}
+		if backoff != want || time.Since(start) < want {
+			t.Fatalf("backoff %s after %s, want %s", backoff, time.Since(start), want)
+		}
+	}
+
+	// Capped, and stopped by ctx while waiting
+	ctx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	backoff = maxAcceptBackoff
+	start := time.Now()
+	if !acceptStopped(ctx, tempError{}, &backoff) || backoff != maxAcceptBackoff {
+		t.Fatalf("not stopped by ctx, backoff %s", backoff)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("stopped after %s", d)
+	}
+
+	backoff = 0
+	if !acceptStopped(context.Background(), net.ErrClosed, &backoff) || !acceptStopped(context.Background(), errors.New("fatal"), &backoff) {
+		t.Fatal("not stopped by a closed listener or a fatal error")
+	}
+}
+
+func TestTunnelShutdown(t *testing.T) {
+	echo := startEcho(t)
+	udpEcho := startUDPEcho(t)
+	sock := filepath.Join(t.TempDir(), "in.sock")
+
+	tests := []struct {
+		network string
+		in      string
+		out     string
+	}{
+		{"tcp", "tcp://" + freeAddr(t, "tcp"), "tcp://" + echo.Addr().String()},
+		{"udp", "udp://" + freeAddr(t, "udp"), "udp://" + udpEcho.LocalAddr().String()},
+		{"unix", "unix://" + sock, "tcp://" + echo.Addr().String()},
+		{"tcp", "mux+tcp://" + freeAddr(t, "tcp"), "tcp://" + echo.Addr().String()},
+		{"tcp", "socks5://" + freeAddr(t, "tcp"), ""},
+	}
+	for _, tt := range tests {
+		name := t.Name() + "/" + tt.in
+		stop := startTunnel(t, ProxyChainTunnel{Name: name, InAddr: tt.in, OutAddr: tt.out})
+
+		start := time.Now()
+		stop()
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s stopped after %s", tt.in, d)
+		}
+
+		// The listener is closed, the address can be listened again
+		a, _ := ResolveAddr(tt.in)
+		address := a.Host
+		if a.IsUnix {
+			address = a.UnixAddr.Name
+		}
+		if tt.network == "udp" {
+			conn, err := net.ListenPacket("udp", address)
+			if err != nil {
+				t.Errorf("%s not closed: %v", tt.in, err)
+				continue
+			}
+			conn.Close()
+		} else {
+			l, err := net.Listen(tt.network, address)
+			if err != nil {
+				t.Errorf("%s not closed: %v", tt.in, err)
+				continue
+			}
+			l.Close()
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SRV outbound expand SRV records to backends when dialing, like:
+//
+//	srv://_http._tcp.example.com?connect_timeout=3s
+//	srv://_dns._udp.example.com
+//
+// The proto _tcp or _udp is the network of backends. Backends of the lowest priority
+// are picked randomly by weight like RFC 2782, the next priority is tried if all failed.
+// Records are cached for their TTL, the last records are kept if lookup failed.
+// Options of the address are options of every backend, but idle pool is of the srv address.
+
+// srvNetwork the network of SRV name by its proto, like: _dns._udp.example.com
+func srvNetwork(name string) (string, error) {
+	labels := strings.SplitN(name, ".", 3)
+	if len(labels) != 3 || !strings.HasPrefix(labels[0], "_") || labels[2] == "" {
+		return "", errors.New("invalid srv name: " + name)
+	}
+	switch labels[1] {
+	case "_tcp":
+		return "tcp", nil
+	case "_udp":
+		return "udp", nil
+	}
+	return "", errors.New("srv proto should be _tcp or _udp: " + name)
+}
+
+// ProxyTunnelSRVDialer connect a backend of SRV records
+type ProxyTunnelSRVDialer struct {
+	Addr *ProxyProtoAddr
+
+	mu sync.Mutex
+	// records the records of groups, groups are rebuilt if records changed
+	records string
+	// groups of backends by priority
+	groups []*ProxyTunnelGroupDialer
+}
+
+// SupportMultiplex srv dialer not support multiplex
+func (p *ProxyTunnelSRVDialer) SupportMultiplex() bool {
+	return false
+}
+
+// IsConnectionless srv dialer is connectionless if proto is _udp
+func (p *ProxyTunnelSRVDialer) IsConnectionless() bool {
+	return p.Addr != nil && p.Addr.IsUDP
+}
+
+// SetAddr set a srv ProxyProtoAddr
+func (p *ProxyTunnelSRVDialer) SetAddr(a *ProxyProtoAddr) {
+	p.Addr = a
+}
+
+// GetConn connect a backend without client
+func (p *ProxyTunnelSRVDialer) GetConn() (net.Conn, error) {
+	return p.GetConnFor(context.Background(), nil)
+}
+
+// GetStream srv not support multiplex
+func (p *ProxyTunnelSRVDialer) GetStream() (interface{}, error) {
+	return nil, errors.New("srv not support multiplex")
+}
+
+// GetConnFor connect a backend of the lowest priority, the next priority if all failed
+func (p *ProxyTunnelSRVDialer) GetConnFor(ctx context.Context, client net.Addr) (net.Conn, error) {
+	if p.Addr == nil {
+		return nil, errors.New("not init dailer address")
+	}
+	groups, err := p.lookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, g := range groups {
+		conn, e := g.GetConnFor(ctx, client)
+		if e == nil {
+			return conn, nil
+		}
+		err = e
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// lookup the groups of current records until ctx is done
+func (p *ProxyTunnelSRVDialer) lookup(ctx context.Context) ([]*ProxyTunnelGroupDialer, error) {
+	srvs, err := getResolver().LookupSRV(ctx, p.Addr.SRV)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil || len(srvs) == 0 {
+		if err == nil {
+			err = errors.New("no srv records: " + p.Addr.SRV)
+		}
+		if len(p.groups) == 0 {
+			return nil, err
+		}
+		log.Warnf("lookup %s failed: %s, keep last records", p.Addr.SRV, err)
+		return p.groups, nil
+	}
+
+	srvs = append([]*net.SRV(nil), srvs...)
+	sort.Slice(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return fmt.Sprint(srvs[i].Target, srvs[i].Port) < fmt.Sprint(srvs[j].Target, srvs[j].Port)
+	})
+	records := ""
+	for _, srv := range srvs {
+		records += fmt.Sprintf("%d %d %s:%d,", srv.Priority, srv.Weight, srv.Target, srv.Port)
+	}
+	if records == p.records {
+		return p.groups, nil
+	}
+
+	var groups []*ProxyTunnelGroupDialer
+	for i := 0; i < len(srvs); {
+		ga := &ProxyProtoAddr{IsTCP: p.Addr.IsTCP, IsUDP: p.Addr.IsUDP, Balance: BalanceRandom}
+		addrs := []string{}
+		for j := i; j < len(srvs) && srvs[j].Priority == srvs[i].Priority; j++ {
+			member := p.backend(srvs[j])
+			ga.Group = append(ga.Group, member)
+			addrs = append(addrs, member.Addr)
+		}
+		i += len(ga.Group)
+		ga.Addr = "group://" + strings.Join(addrs, ",")
+
+		g := new(ProxyTunnelGroupDialer)
+		g.SetAddr(ga)
+		groups = append(groups, g)
+	}
+	log.Infof("srv %s records: %s", p.Addr.SRV, strings.TrimSuffix(records, ","))
+	p.records, p.groups = records, groups
+	return groups, nil
+}
+
+// backend the address of a SRV record, a hostname resolved when dialing
+func (p *ProxyTunnelSRVDialer) backend(srv *net.SRV) *ProxyProtoAddr {
+	network := "tcp"
+	if p.Addr.IsUDP {
+		network = "udp"
+	}
+	options := url.Values{}
+	for k, v := range p.Addr.Options {
+		if !strings.HasPrefix(k, "pool_") {
+			options[k] = v
+		}
+	}
+	// Weight 0 is rarely selected if others are not 0
+	weight := int(srv.Weight)
+	if weight == 0 {
+		weight = 1
+	}
+	options.Set("weight", strconv.Itoa(weight))
+
+	host := net.JoinHostPort(srv.Target, strconv.Itoa(int(srv.Port)))
+	return &ProxyProtoAddr{
+		Addr:    network + "://" + host,
+		Host:    host,
+		IsTCP:   p.Addr.IsTCP,
+		IsUDP:   p.Addr.IsUDP,
+		Options: options,
+	}
+}
@@ -1,10 +1,13 @@
 package lib
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
-	"os/signal"
 	"sync"
-	"syscall"
+	"sync/atomic"
+	"time"
 
 	logging "github.com/go-fastlog/fastlog"
 )
@@ -13,92 +16,348 @@ var log = logging.New(os.Stderr, "tunnel", logging.Ldebug)
 
 // ProxyChainTunnel compose TunnelServer and Dialer
 type ProxyChainTunnel struct {
+	Name          string
 	InAddr        string
 	OutAddr       string
 	InProtoAddr   *ProxyProtoAddr
 	OutPrototAddr *ProxyProtoAddr
+	// Upstreams an upstream group instead of OutAddr, selected by Balance
+	Upstreams []string
+	Balance   string
+	// HealthCheck probe backends of Upstreams, nil not to check
+	HealthCheck *HealthCheck
+	// MirrorAddrs more outbounds receiving copies of datagrams of a udp inbound
+	MirrorAddrs []string
+
+	// UDPTimeout how long to wait a udp response, zero means 3s
+	UDPTimeout time.Duration
+	// UDPIdleTimeout close a udp session without datagrams, zero means 60s
+	UDPIdleTimeout time.Duration
+	// UDPMaxDatagram max bytes of a udp datagram, zero means 1500
+	UDPMaxDatagram int
+	// StreamIdleTimeout close a stream without data in both directions, zero never
+	StreamIdleTimeout time.Duration
+	// Limits of connections, nil is unlimited but counted for max connections of all tunnels
+	Limits *ConnLimits
+	// Shaping rates and quotas of bytes, nil is unlimited
+	Shaping *Shaping
+	// DrainTimeout wait connections to finish on stop before closing them, zero means 30s
+	DrainTimeout time.Duration
+
+	limiter   *connLimiter
+	shaper    *shaper
+	sessions  *udpSessionTable
+	datagrams *datagramLimit
+	mirrors   []*udpMirror
+	status    *tunnelStatus
 
 	s ProxyTunnelServer
 	d ProxyTunnelDialer
 }
 
-// Serve A Tunnel Connect Inbound and Outbound
-func (p ProxyChainTunnel) Serve() {
+// defaultDrainTimeout wait connections to finish on stop
+const defaultDrainTimeout = 30 * time.Second
+
+// drainLogInterval log the progress of draining
+const drainLogInterval = 5 * time.Second
+
+// Run a tunnel connecting inbound and outbound until ctx is done, an error if it can not start.
+// On stop, the listener is closed at once, connections are drained until DrainTimeout,
+// then the rest are closed.
+func (p ProxyChainTunnel) Run(ctx context.Context) (err error) {
+	p.status = registerTunnel(p.Name)
+	// A tunnel failed to start is not waited by readiness
+	defer func() {
+		if err != nil {
+			p.status.set(tunnelFailed)
+		} else {
+			p.status.set(tunnelStopped)
+		}
+	}()
+
 	inaddr, err := ResolveAddr(p.InAddr)
 	if err != nil {
-		log.Errorf("parse inbound address %s, error: %s", p.InAddr, err)
-		return
+		return fmt.Errorf("parse inbound address %s, error: %s", p.InAddr, err)
 	}
 
-	outaddr, err := ResolveAddr(p.OutAddr)
-	if err != nil {
-		log.Errorf("parse outbound address %s, error: %s", p.OutAddr, err)
-		return
-	}
+	// Servers are stopped when the tunnel returns
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Reverse names are kept for the connections draining to agents
+	lifetime, release := context.WithCancel(context.Background())
+	defer release()
 
-	if inaddr.IsTCP && outaddr.IsUDP {
-		log.Errorf("not support create a tunnel from tcp to udp protocol, in: %s, out: %s", inaddr.Addr, outaddr.Addr)
-		return
-	} else if inaddr.IsUDP && !outaddr.IsUDP {
-		log.Warnf("not support create a tunnel from tcp to udp protocol, in: %s, out: %s", inaddr.Addr, outaddr.Addr)
+	// The destination of dynamic inbound comes from client handshake
+	if inaddr.IsDynamic() {
+		if p.OutAddr != "" {
+			return fmt.Errorf("inbound %s takes destination from client, not need outbound %s", inaddr.Addr, p.OutAddr)
+		}
+		p.InProtoAddr = inaddr
+		if p.Name != "" {
+			log.Infof("start tunnel %s: %s -> *", p.Name, inaddr.Addr)
+		}
+	} else if err := p.resolveOutbound(lifetime, inaddr); err != nil {
+		return err
 	}
 
-	p.InProtoAddr = inaddr
-	p.OutPrototAddr = outaddr
+	p.datagrams = newDatagramLimit(p.Name, p.UDPMaxDatagram)
+	p.limiter = newConnLimiter(p.Name, p.Limits)
+	p.shaper = newShaper(p.Name, p.Shaping)
 
 	var s ProxyTunnelServer
 
-	if inaddr.IsTCP {
+	if inaddr.IsMux {
+		s = NewProxyTunnelMuxServer()
+	} else if inaddr.IsAgent {
+		s = new(ProxyTunnelAgentServer)
+	} else if inaddr.IsSOCKS5 {
+		s = NewProxyTunnelSOCKS5Server(inaddr)
+	} else if inaddr.IsHTTPConnect {
+		s = NewProxyTunnelHTTPConnectServer(inaddr)
+	} else if inaddr.IsTCP {
 		s = NewProxyTunnelTCPServer()
 	} else if inaddr.IsUDP {
-		s = new(ProxyTunnelUDPServer)
+		s = &ProxyTunnelUDPServer{datagrams: p.datagrams}
 	} else if inaddr.IsUnix {
 		s = new(ProxyTunnelUnixServer)
 	}
+	if ts, ok := s.(*ProxyTunnelTCPServer); ok {
+		ts.limiter = p.limiter
+	}
+	p.s = s
+
+	// Datagrams of udp and socks5 clients go by sessions
+	if inaddr.IsUDP || inaddr.IsSOCKS5 {
+		p.sessions = newUDPSessionTable(p.Name, p.UDPIdleTimeout, p.datagrams, p.limiter)
+		defer p.sessions.Close()
+	}
+
+	for _, m := range p.mirrors {
+		defer m.Close()
+	}
+
+	// Create dialers ahead, idle pools are filled before clients come
+	if p.OutPrototAddr != nil {
+		for _, a := range append([]*ProxyProtoAddr{p.OutPrototAddr}, p.OutPrototAddr.Group...) {
+			AllDialerPools.GetDailer(a)
+		}
+	}
+
+	if p.HealthCheck != nil && p.OutPrototAddr != nil && len(p.OutPrototAddr.Group) > 0 {
+		if d, ok := AllDialerPools.GetDailer(p.OutPrototAddr).(*ProxyTunnelGroupDialer); ok {
+			defer startHealthCheck(p.Name, *p.HealthCheck, d).Stop()
+		}
+	}
 
 	wg := new(sync.WaitGroup)
 
-	ch := s.Serve(inaddr, wg)
+	ch := s.Serve(ctx, inaddr, wg)
 
 	if ch == nil {
-		log.Errorf("create a %s server failed", inaddr.Addr)
-		return
+		return errors.New("create a " + inaddr.Addr + " server failed")
 	}
 
+	p.status.set(tunnelServing)
+
 	// If performace, use more goroutine here
-	go p.HandleConnection(ch, wg)
+	p.HandleConnection(ctx, ch)
 
 	// wait server quit
 	wg.Wait()
 
+	// Streams are drained or closed, the sessions carrying them can go
+	p.closeSessions()
+
+	if p.Name != "" {
+		log.Infof("stop tunnel %s", p.Name)
+	}
+	return nil
 }
 
-// HandleConnection start proxy data
-func (p ProxyChainTunnel) HandleConnection(ch <-chan *ProxyChainConn, wg *sync.WaitGroup) {
+// resolveOutbound resolve and check outbound address for the inbound
+func (p *ProxyChainTunnel) resolveOutbound(ctx context.Context, inaddr *ProxyProtoAddr) error {
+	var outaddr *ProxyProtoAddr
+	var err error
+	if len(p.Upstreams) > 0 {
+		if p.OutAddr != "" {
+			return fmt.Errorf("outbound %s and upstreams should not be both given", p.OutAddr)
+		}
+		outaddr, err = NewGroupAddr(p.Upstreams, p.Balance)
+	} else {
+		outaddr, err = ResolveAddr(p.OutAddr)
+	}
+	if err != nil {
+		return fmt.Errorf("parse outbound address %s, error: %s", p.OutAddr, err)
+	}
 
-	quitC := make(chan os.Signal, 1)
-	signal.Notify(quitC, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	if !inaddr.IsUDP && outaddr.IsUDP && inaddr.Options.Get("framing") == "" {
+		return fmt.Errorf("not support create a tunnel from stream to udp protocol without framing, in: %s, out: %s", inaddr.Addr, outaddr.Addr)
+	} else if inaddr.IsUDP && !outaddr.IsUDP {
+		log.Warnf("not support create a tunnel from tcp to udp protocol, in: %s, out: %s", inaddr.Addr, outaddr.Addr)
+	}
 
-	wg.Add(1)
-	defer wg.Done()
+	if inaddr.IsReverse || inaddr.SRV != "" || outaddr.IsAgent {
+		return fmt.Errorf("reverse and srv addresses are only outbound, agent address is only inbound, in: %s, out: %s", inaddr.Addr, outaddr.Addr)
+	}
+
+	for _, a := range append([]*ProxyProtoAddr{outaddr}, outaddr.Group...) {
+		if !a.IsReverse {
+			continue
+		}
+		if err := ListenReverse(ctx, a); err != nil {
+			return fmt.Errorf("listen for agents on %s failed: %s", a.Addr, err)
+		}
+	}
+
+	if len(p.MirrorAddrs) > 0 && !inaddr.IsUDP {
+		return fmt.Errorf("mirror only datagrams of udp inbound, in: %s", inaddr.Addr)
+	}
+	for _, mirror := range p.MirrorAddrs {
+		mirroraddr, err := ResolveAddr(mirror)
+		if err != nil {
+			return fmt.Errorf("parse mirror address %s, error: %s", mirror, err)
+		}
+		if !isMirrorAddr(mirroraddr) {
+			return fmt.Errorf("mirror should be a udp or unix address: %s", mirroraddr.Addr)
+		}
+		p.mirrors = append(p.mirrors, newUDPMirror(p.Name, mirroraddr))
+		log.Infof("mirror datagrams of %s to %s", inaddr.Addr, mirroraddr.Addr)
+	}
+
+	p.InProtoAddr = inaddr
+	p.OutPrototAddr = outaddr
+
+	if p.Name != "" {
+		log.Infof("start tunnel %s: %s -> %s", p.Name, inaddr.Addr, outaddr.Addr)
+	}
+
+	return nil
+}
+
+// HandleConnection start proxy data of connections from ch until ctx is done, then drain them
+func (p ProxyChainTunnel) HandleConnection(ctx context.Context, ch <-chan *ProxyChainConn) {
+	status := p.status
+	if status == nil {
+		status = new(tunnelStatus)
+	}
+
+	// Connections are closed after the drain timeout
+	connCtx, forceClose := context.WithCancel(context.Background())
+	defer forceClose()
 
 	pwg := sync.WaitGroup{}
 
 ProxyLabel:
 	for {
 		select {
-		case <-quitC:
+		case <-ctx.Done():
 			break ProxyLabel
 		case conn := <-ch:
-			go func() {
-				pwg.Add(1)
+			to := p.OutPrototAddr
+			if conn.Dest != nil {
+				to = conn.Dest
+			}
+			pwg.Add(1)
+			atomic.AddInt64(&status.conns, 1)
+			handle := func() {
 				defer pwg.Done()
-				conn.Exchange(p.OutPrototAddr)
-			}()
-		default:
+				defer atomic.AddInt64(&status.conns, -1)
+				conn.ctx = connCtx
+				conn.udpTimeout = p.UDPTimeout
+				conn.idleTimeout = p.StreamIdleTimeout
+				conn.framing = p.InProtoAddr.Options.Get("framing")
+				conn.sessions = p.sessions
+				if conn.datagrams == nil {
+					conn.datagrams = p.datagrams
+				}
+				conn.shaper = p.shaper
+				if p.shaper != nil && conn.InUDPRemoteAddr != nil && !p.shaper.allowDatagram(conn.InUDPRemoteAddr, len(conn.UDPData), true) {
+					conn.Close()
+					return
+				}
+				if conn.InUDPRemoteAddr != nil && len(p.mirrors) > 0 {
+					// The buffer of datagram is released after exchange
+					data := append([]byte(nil), conn.UDPData...)
+					for _, m := range p.mirrors {
+						m.send(data)
+					}
+				}
+				// A new udp session is limited by the session table
+				if conn.InUDPRemoteAddr == nil || p.sessions == nil || !to.IsUDP {
+					release, err := p.limiter.acquire(conn.clientAddr(), conn.InUDPRemoteAddr == nil)
+					if err != nil {
+						log.Warnf("refuse %s of tunnel %s: %s", conn.clientAddr(), p.Name, err)
+						conn.Close()
+						return
+					}
+					defer release()
+				}
+				if p.shaper != nil && conn.InUDPRemoteAddr == nil {
+					cs := p.shaper.client(conn.clientAddr())
+					err := p.shaper.admit(cs)
+					p.shaper.release(cs)
+					if err != nil {
+						log.Warnf("refuse %s of tunnel %s: %s", conn.clientAddr(), p.Name, err)
+						conn.Close()
+						return
+					}
+				}
+				conn.Exchange(to)
+			}
+			// Datagrams of udp sessions are queued without blocking, in the order of receiving
+			if conn.InUDPRemoteAddr != nil && p.sessions != nil && to.IsUDP {
+				handle()
+			} else {
+				go handle()
+			}
 		}
 	}
 
-	pwg.Wait()
+	status.set(tunnelDraining)
+	p.drain(&pwg, status, forceClose)
+}
+
+// drain wait connections to finish until the drain timeout, then close the rest
+func (p ProxyChainTunnel) drain(pwg *sync.WaitGroup, status *tunnelStatus, forceClose func()) {
+	done := make(chan struct{})
+	go func() {
+		pwg.Wait()
+		close(done)
+	}()
+
+	timeout := p.DrainTimeout
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	log.Infof("stop accepting of %s, drain %d connections in %s", p.Name, status.active(), timeout)
+
+	start := time.Now()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			log.Infof("drained %s in %s", p.Name, time.Since(start).Round(time.Millisecond))
+			return
+		case <-ticker.C:
+			log.Infof("draining %s: %d connections, %s left", p.Name, status.active(), (timeout - time.Since(start)).Round(time.Second))
+		case <-deadline.C:
+			log.Warnf("drain timeout of %s, close %d connections", p.Name, status.active())
+			forceClose()
+			// A closed stream still reads until the client closes it, the session stops it
+			p.closeSessions()
+			<-done
+			return
+		}
+	}
+}
 
+// closeSessions close mux sessions of the server, if it has
+func (p ProxyChainTunnel) closeSessions() {
+	if ss, ok := p.s.(ProxyTunnelSessionServer); ok {
+		ss.CloseSessions()
+	}
 }
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// viaDialTimeout limit the time of connecting and negotiating with all proxies, unless connect_timeout is given
+const viaDialTimeout = 30 * time.Second
+
+// ProxyTunnelViaDialer connect a tcp address through socks5 or http proxies
+type ProxyTunnelViaDialer struct {
+	Addr *ProxyProtoAddr
+}
+
+// SupportMultiplex via dialer not support multiplex
+func (p *ProxyTunnelViaDialer) SupportMultiplex() bool {
+	return false
+}
+
+// IsConnectionless via dialer is connection-oriented
+func (p *ProxyTunnelViaDialer) IsConnectionless() bool {
+	return false
+}
+
+// SetAddr set a ProxyProtoAddr with proxies
+func (p *ProxyTunnelViaDialer) SetAddr(a *ProxyProtoAddr) {
+	p.Addr = a
+}
+
+// GetConn connect the first proxy, then ask every proxy to connect the next one
+func (p *ProxyTunnelViaDialer) GetConn() (net.Conn, error) {
+	return p.GetConnFor(context.Background(), nil)
+}
+
+// GetConnFor connect through all proxies until ctx is done
+func (p *ProxyTunnelViaDialer) GetConnFor(ctx context.Context, client net.Addr) (net.Conn, error) {
+	if p.Addr == nil || len(p.Addr.Via) == 0 {
+		return nil, errors.New("not init dailer address")
+	}
+	return dialWithPolicy(ctx, p.Addr, func(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+		// Negotiating with proxies takes longer than a connect
+		if p.Addr.Options.Get("connect_timeout") == "" {
+			timeout = viaDialTimeout
+		}
+		return p.dialChain(ctx, timeout)
+	})
+}
+
+// dialChain connect and negotiate with all proxies in timeout
+func (p *ProxyTunnelViaDialer) dialChain(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	conn, err := dialHost(ctx, "tcp", p.Addr.Via[0].Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	// Stop negotiating when ctx is done
+	raw := conn
+	stop := context.AfterFunc(ctx, func() { raw.SetDeadline(time.Now()) })
+
+	for i, proxy := range p.Addr.Via {
+		next := p.Addr
+		if i+1 < len(p.Addr.Via) {
+			next = p.Addr.Via[i+1]
+		}
+
+		user, pass := proxy.Options.Get("user"), proxy.Options.Get("pass")
+		if proxy.IsSOCKS5 {
+			err = socks5Connect(conn, next.Host, user, pass)
+		} else {
+			// The connection may be wrapped with data buffered after response
+			var tunneled net.Conn
+			if tunneled, err = httpConnect(conn, next.Host, user, pass); err == nil {
+				conn = tunneled
+			}
+		}
+		if err != nil {
+			stop()
+			conn.Close()
+			return nil, errors.New("via " + proxy.Addr + ": " + err.Error())
+		}
+	}
+
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// GetStream via dialer not support multiplex
+func (p *ProxyTunnelViaDialer) GetStream() (interface{}, error) {
+	return nil, errors.New("Via proxies not support multiplex")
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// startRejectingProxy a http proxy answering every CONNECT with status
+func startRejectingProxy(t *testing.T, status string) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 " + status + "\r\nContent-Length: 0\r\n\r\n"))
+			}()
+		}
+	}()
+	return l
+}
+
+func TestViaProxyRejected(t *testing.T) {
+	for _, status := range []string{"407 Proxy Authentication Required", "502 Bad Gateway"} {
+		proxy := startRejectingProxy(t, status)
+		a, err := ResolveAddr("tcp://127.0.0.1:9?via=http-connect://" + proxy.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialer := &ProxyTunnelViaDialer{}
+		dialer.SetAddr(a)
+		conn, err := dialer.GetConn()
+		if conn != nil || err == nil || !strings.Contains(err.Error(), status) {
+			t.Fatalf("dial via proxy answering %s: %v %v", status, conn, err)
+		}
+	}
+}
+
+func TestViaProxyShortResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Write([]byte("HTTP/1.1 200"))
+			conn.Close()
+		}
+	}()
+
+	a, err := ResolveAddr("tcp://127.0.0.1:9?via=http-connect://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &ProxyTunnelViaDialer{}
+	dialer.SetAddr(a)
+	if conn, err := dialer.GetConn(); conn != nil || err == nil {
+		t.Fatalf("dial via proxy closing early: %v %v", conn, err)
+	}
+}
+
+func TestViaProxyChain(t *testing.T) {
+	echo := startEcho(t)
+	socks := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{Name: t.Name() + "/socks5", InAddr: "socks5://" + socks + "?user=alice&pass=secret"})
+	connect := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{Name: t.Name() + "/http", InAddr: "http-connect://" + connect})
+
+	in := freeAddr(t, "tcp")
+	out := "socks5://alice:secret@" + socks + "/http-connect://" + connect + "/tcp://" + echo.Addr().String()
+	startTunnel(t, ProxyChainTunnel{InAddr: "tcp://" + in, OutAddr: out})
+
+	conn, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := roundTrip(t, conn, "through two proxies"); got != "through two proxies" {
+		t.Fatalf("echo %q", got)
+	}
+}
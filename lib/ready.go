@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Readiness of tunnels by http, like:
+//
+//	ready_addr: 127.0.0.1:8086
+//
+// GET /ready answers 200 when all tunnels are serving, 503 when any is starting, draining
+// or stopped, so a load balancer stops sending clients before the connections are drained.
+// A tunnel failed to start is listed as failed, but does not hold the others unready.
+// Every line of body is a tunnel with its state and active connections, like: web serving 12
+//
+// GET /metrics answers counters and gauges, like ServeMetrics
+
+// States of a tunnel
+const (
+	tunnelStarting int32 = iota
+	tunnelServing
+	tunnelDraining
+	tunnelStopped
+	tunnelFailed
+)
+
+var tunnelStateNames = []string{"starting", "serving", "draining", "stopped", "failed"}
+
+// tunnelStatus the state and active connections of a tunnel
+type tunnelStatus struct {
+	state int32
+	conns int64
+}
+
+func (s *tunnelStatus) set(state int32) {
+	atomic.StoreInt32(&s.state, state)
+}
+
+func (s *tunnelStatus) get() int32 {
+	return atomic.LoadInt32(&s.state)
+}
+
+func (s *tunnelStatus) active() int64 {
+	return atomic.LoadInt64(&s.conns)
+}
+
+// tunnels status of all tunnels by name
+var tunnels = struct {
+	mu     sync.Mutex
+	status map[string]*tunnelStatus
+}{status: make(map[string]*tunnelStatus)}
+
+// registerTunnel the status of tunnel, a tunnel of the same name runs again is starting
+func registerTunnel(name string) *tunnelStatus {
+	tunnels.mu.Lock()
+	defer tunnels.mu.Unlock()
+	s, ok := tunnels.status[name]
+	if !ok {
+		s = new(tunnelStatus)
+		tunnels.status[name] = s
+	}
+	s.set(tunnelStarting)
+	return s
+}
+
+// tunnelStatuses status of all tunnels sorted by name
+func tunnelStatuses() ([]string, []*tunnelStatus) {
+	tunnels.mu.Lock()
+	defer tunnels.mu.Unlock()
+	names := make([]string, 0, len(tunnels.status))
+	for name := range tunnels.status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	status := make([]*tunnelStatus, len(names))
+	for i, name := range names {
+		status[i] = tunnels.status[name]
+	}
+	return names, status
+}
+
+// Ready all tunnels are serving, except the failed ones
+func Ready() bool {
+	_, status := tunnelStatuses()
+	return ready(status)
+}
+
+// ready at least a tunnel is serving, and others are serving or failed
+func ready(status []*tunnelStatus) bool {
+	serving := 0
+	for _, s := range status {
+		switch s.get() {
+		case tunnelServing:
+			serving++
+		case tunnelFailed:
+		default:
+			return false
+		}
+	}
+	return serving > 0
+}
+
+// serveReady answer readiness of all tunnels
+func serveReady(w http.ResponseWriter, r *http.Request) {
+	names, status := tunnelStatuses()
+	var body strings.Builder
+	for i, s := range status {
+		fmt.Fprintf(&body, "%s %s %d\n", names[i], tunnelStateNames[s.get()], s.active())
+	}
+	if ready(status) {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	io.WriteString(w, body.String())
+}
+
+// ListenReady serve readiness of tunnels on addr by http, until the server is closed
+func ListenReady(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ready", serveReady)
+	mux.HandleFunc("/metrics", ServeMetrics)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go srv.Serve(listener)
+	log.Infof("start readiness on http://%s/ready", listener.Addr())
+	return srv, nil
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getReady the status code and body of /ready
+func getReady(t *testing.T) (int, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	serveReady(w, httptest.NewRequest("GET", "/ready", nil))
+	return w.Code, w.Body.String()
+}
+
+// waitState wait the tunnel of name to be in state
+func waitState(t *testing.T, name string, state int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnelState(name) != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel %s %d, want %d", name, tunnelState(name), state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReadyDraining(t *testing.T) {
+	echo := startEcho(t)
+	in := freeAddr(t, "tcp")
+	stop := startTunnel(t, ProxyChainTunnel{
+		InAddr:       "tcp://" + in,
+		OutAddr:      "tcp://" + echo.Addr().String(),
+		DrainTimeout: 5 * time.Second,
+	})
+
+	conn, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip(t, conn, "hello")
+	if code, body := getReady(t); code != http.StatusOK || body != t.Name()+" serving 1\n" {
+		t.Fatalf("serving: %d %q", code, body)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+
+	// Unready at stop, while the connection still relays
+	waitState(t, t.Name(), tunnelDraining)
+	if code, body := getReady(t); code != http.StatusServiceUnavailable || body != t.Name()+" draining 1\n" {
+		t.Fatalf("draining: %d %q", code, body)
+	}
+	roundTrip(t, conn, "again")
+	select {
+	case <-stopped:
+		t.Fatal("stopped before the connection is drained")
+	default:
+	}
+
+	conn.Close()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("not stopped after the connection is drained")
+	}
+}
+
+func TestDrainForceClose(t *testing.T) {
+	echo := startEcho(t)
+	in := freeAddr(t, "tcp")
+	timeout := 300 * time.Millisecond
+	stop := startTunnel(t, ProxyChainTunnel{
+		InAddr:       "tcp://" + in,
+		OutAddr:      "tcp://" + echo.Addr().String(),
+		DrainTimeout: timeout,
+	})
+
+	conn, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip(t, conn, "hello")
+
+	start := time.Now()
+	go stop()
+
+	// The idle connection is cut at the drain timeout, not before
+	_, err = conn.Read(make([]byte, 1))
+	d := time.Since(start)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection not closed at the drain timeout")
+	}
+	if d < timeout || d > timeout+time.Second {
+		t.Fatalf("connection closed after %s, want %s", d, timeout)
+	}
+}
+
+func TestReadyFailed(t *testing.T) {
+	echo := startEcho(t)
+	startTunnel(t, ProxyChainTunnel{
+		Name:    t.Name() + "/ok",
+		InAddr:  "tcp://" + freeAddr(t, "tcp"),
+		OutAddr: "tcp://" + echo.Addr().String(),
+	})
+
+	// The address is taken, the server fails to start
+	failed := t.Name() + "/taken"
+	defer func() {
+		tunnels.mu.Lock()
+		delete(tunnels.status, failed)
+		tunnels.mu.Unlock()
+	}()
+	err := ProxyChainTunnel{
+		Name:    failed,
+		InAddr:  "tcp://" + echo.Addr().String(),
+		OutAddr: "tcp://" + echo.Addr().String(),
+	}.Run(context.Background())
+	if err == nil {
+		t.Fatal("tunnel on a taken address started")
+	}
+	if tunnelState(failed) != tunnelFailed {
+		t.Fatalf("state %d, want failed", tunnelState(failed))
+	}
+
+	// The failed tunnel is listed, the serving one is ready
+	if !Ready() {
+		t.Fatal("not ready by a failed tunnel")
+	}
+	addr := freeAddr(t, "tcp")
+	srv, err := ListenReady(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	for _, tt := range []struct{ path, want string }{
+		{"/ready", failed + " failed 0\n"},
+		{"/metrics", t.Name() + "/ok.udp_truncated 0\n"},
+	} {
+		resp, err := http.Get("http://" + addr + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), tt.want) {
+			t.Errorf("%s: %d %q, want %q", tt.path, resp.StatusCode, body, tt.want)
+		}
+	}
+}
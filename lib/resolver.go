@@ -0,0 +1,528 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Hostnames of outbounds are resolved when dialing, not once at startup, the records
+// are cached for their TTL. All A and AAAA records are connected like Happy Eyeballs
+// (RFC 8305), a next address is tried after 250ms or a failure, the first connected wins.
+//
+// A name in /etc/hosts is taken first, it is read again when changed. Other names are
+// asked to the nameservers of /etc/resolv.conf, a name they don't know (like a short name
+// of search domains) is resolved by the system for 30s. Resolving stops with the context.
+
+const (
+	dnsQueryTimeout = 2 * time.Second
+	// dnsFallbackTTL cache the results of system resolver without TTL
+	dnsFallbackTTL = 30 * time.Second
+	// dnsNegativeTTL cache failures of resolving
+	dnsNegativeTTL = 5 * time.Second
+	dnsMinTTL      = time.Second
+	dnsMaxTTL      = time.Hour
+	// dnsCacheSize the max entries cached, expired ones are dropped first when full
+	dnsCacheSize = 4096
+
+	happyEyeballsDelay = 250 * time.Millisecond
+)
+
+// dnsEntry a cached result of resolving
+type dnsEntry struct {
+	ips     []net.IP
+	srvs    []*net.SRV
+	err     error
+	expires time.Time
+}
+
+// dnsResolver query nameservers with a cache by TTL
+type dnsResolver struct {
+	servers []string
+	// hostsFile names taken before nameservers, like /etc/hosts
+	hostsFile string
+	// now the clock of TTL
+	now func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]*dnsEntry
+	// hosts addresses of names in hostsFile read at hostsModTime
+	hosts        map[string][]net.IP
+	hostsModTime time.Time
+}
+
+// newDNSResolver query servers, like 10.0.0.2:53
+func newDNSResolver(servers []string) *dnsResolver {
+	return &dnsResolver{servers: servers, now: time.Now, cache: make(map[string]*dnsEntry)}
+}
+
+var (
+	defaultResolverOnce sync.Once
+	defaultResolver     *dnsResolver
+)
+
+// getResolver the resolver of nameservers in /etc/resolv.conf
+func getResolver() *dnsResolver {
+	defaultResolverOnce.Do(func() {
+		defaultResolver = newDNSResolver(readResolvConf("/etc/resolv.conf"))
+		defaultResolver.hostsFile = "/etc/hosts"
+	})
+	return defaultResolver
+}
+
+// readResolvConf the nameservers of resolv.conf
+func readResolvConf(name string) []string {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return servers
+}
+
+// lookupHosts the addresses of host in hosts file, the file is read again when changed
+func (r *dnsResolver) lookupHosts(host string) []net.IP {
+	if r.hostsFile == "" {
+		return nil
+	}
+	info, err := os.Stat(r.hostsFile)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.hosts = nil
+		return nil
+	}
+	if !info.ModTime().Equal(r.hostsModTime) {
+		r.hosts, r.hostsModTime = readHosts(r.hostsFile), info.ModTime()
+	}
+	return r.hosts[strings.ToLower(strings.TrimSuffix(host, "."))]
+}
+
+// readHosts the addresses of every name and alias in a hosts file
+func readHosts(name string) map[string][]net.IP {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(strings.Split(fields[0], "%")[0])
+		if ip == nil {
+			continue
+		}
+		for _, host := range fields[1:] {
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			hosts[host] = append(hosts[host], ip)
+		}
+	}
+	return hosts
+}
+
+// cached the entry of key not expired
+func (r *dnsResolver) cached(key string) *dnsEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.cache[key]; ok && r.now().Before(e.expires) {
+		return e
+	}
+	return nil
+}
+
+func (r *dnsResolver) store(key string, e *dnsEntry, ttl time.Duration) {
+	if ttl < dnsMinTTL {
+		ttl = dnsMinTTL
+	}
+	if ttl > dnsMaxTTL {
+		ttl = dnsMaxTTL
+	}
+	now := r.now()
+	e.expires = now.Add(ttl)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cache[key]; !ok && len(r.cache) >= dnsCacheSize {
+		for k, old := range r.cache {
+			if !now.Before(old.expires) {
+				delete(r.cache, k)
+			}
+		}
+		// Still full of live entries, drop a random one
+		for k := range r.cache {
+			if len(r.cache) < dnsCacheSize {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[key] = e
+}
+
+// LookupIP the addresses of host in hosts file, or all A and AAAA records of host
+func (r *dnsResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ips := r.lookupHosts(host); len(ips) > 0 {
+		return ips, nil
+	}
+	key := "ip " + host
+	if e := r.cached(key); e != nil {
+		return e.ips, e.err
+	}
+
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	answers := make(chan answer, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA} {
+		go func(qtype dnsmessage.Type) {
+			var a answer
+			var msg *dnsmessage.Message
+			if msg, a.err = r.query(ctx, host, qtype); a.err == nil {
+				a.ips, _, a.ttl = parseAnswers(msg)
+			}
+			answers <- a
+		}(qtype)
+	}
+
+	var ips []net.IP
+	ttl := dnsMaxTTL
+	for i := 0; i < 2; i++ {
+		a := <-answers
+		if a.err == nil && len(a.ips) > 0 {
+			ips = append(ips, a.ips...)
+			if a.ttl < ttl {
+				ttl = a.ttl
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		ttl = dnsFallbackTTL
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			// A canceled lookup is not a failure of the name
+			if ctx.Err() == nil {
+				r.store(key, &dnsEntry{err: err}, dnsNegativeTTL)
+			}
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	r.store(key, &dnsEntry{ips: ips}, ttl)
+	return ips, nil
+}
+
+// LookupSRV the SRV records of name, like: _http._tcp.example.com
+func (r *dnsResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	key := "srv " + name
+	if e := r.cached(key); e != nil {
+		return e.srvs, e.err
+	}
+
+	var srvs []*net.SRV
+	ttl := dnsFallbackTTL
+	if msg, err := r.query(ctx, name, dnsmessage.TypeSRV); err == nil {
+		_, srvs, ttl = parseAnswers(msg)
+	}
+	if len(srvs) == 0 {
+		var err error
+		ttl = dnsFallbackTTL
+		if _, srvs, err = net.DefaultResolver.LookupSRV(ctx, "", "", name); err != nil {
+			if ctx.Err() == nil {
+				r.store(key, &dnsEntry{err: err}, dnsNegativeTTL)
+			}
+			return nil, err
+		}
+	}
+
+	r.store(key, &dnsEntry{srvs: srvs}, ttl)
+	return srvs, nil
+}
+
+// parseAnswers the addresses and SRV records in answers, with the min TTL
+func parseAnswers(msg *dnsmessage.Message) ([]net.IP, []*net.SRV, time.Duration) {
+	var ips []net.IP
+	var srvs []*net.SRV
+	ttl := dnsMaxTTL
+	for _, rr := range msg.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(append([]byte(nil), body.A[:]...)))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(append([]byte(nil), body.AAAA[:]...)))
+		case *dnsmessage.SRVResource:
+			target := strings.TrimSuffix(body.Target.String(), ".")
+			srvs = append(srvs, &net.SRV{Target: target, Port: body.Port, Priority: body.Priority, Weight: body.Weight})
+		default:
+			continue
+		}
+		if d := time.Duration(rr.Header.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return ips, srvs, ttl
+}
+
+// query ask the nameservers in turn until ctx is done, over tcp if the answer is truncated
+func (r *dnsResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	req := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	lastErr := errors.New("no nameservers")
+	for _, server := range r.servers {
+		msg, err := exchangeDNS(ctx, "udp", server, packet)
+		if err == nil && msg.Header.Truncated {
+			msg, err = exchangeDNS(ctx, "tcp", server, packet)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if msg.Header.ID != id {
+			lastErr = errors.New("mismatched dns response id")
+			continue
+		}
+		if msg.Header.RCode != dnsmessage.RCodeSuccess {
+			return nil, errors.New("dns " + msg.Header.RCode.String() + ": " + name)
+		}
+		return msg, nil
+	}
+	return nil, lastErr
+}
+
+// exchangeDNS send a query to server and read the response, in a timeout or until ctx is done
+func exchangeDNS(ctx context.Context, network, server string, packet []byte) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	defer context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })()
+
+	var buf []byte
+	if network == "tcp" {
+		// 2 bytes length before message on tcp
+		if _, err := conn.Write(append([]byte{byte(len(packet) >> 8), byte(len(packet))}, packet...)); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, maxDatagram)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	msg := new(dnsmessage.Message)
+	if err := msg.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// dialAddr connect the tcp, udp or unix address in timeout or until ctx is done, a hostname is resolved now
+func dialAddr(ctx context.Context, a *ProxyProtoAddr, timeout time.Duration) (net.Conn, error) {
+	if a.IsUnix {
+		d := net.Dialer{Timeout: timeout}
+		return d.DialContext(ctx, a.UnixAddr.Network(), a.UnixAddr.String())
+	}
+	return dialHost(ctx, addrNetwork(a), a.Host, timeout)
+}
+
+// addrNetwork tcp or udp of address, tcp4 or tcp6 if given like: tcp6://example.com:80
+func addrNetwork(a *ProxyProtoAddr) string {
+	network := "tcp"
+	if a.IsUDP {
+		network = "udp"
+	}
+	scheme := strings.SplitN(a.Addr, "://", 2)[0]
+	if strings.HasSuffix(scheme, "4") || strings.HasSuffix(scheme, "6") {
+		network += scheme[len(scheme)-1:]
+	}
+	return network
+}
+
+// dialHost connect host:port of network in timeout or until ctx is done, a hostname is resolved now
+func dialHost(ctx context.Context, network, hostport string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: timeout}
+	if host == "" || net.ParseIP(strings.Split(host, "%")[0]) != nil {
+		return d.DialContext(ctx, network, hostport)
+	}
+
+	ips, err := getResolver().LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = filterFamily(network, ips)
+	if len(ips) == 0 {
+		return nil, errors.New("no address of " + network + " for " + host)
+	}
+
+	if strings.HasPrefix(network, "udp") {
+		return d.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+	}
+	return dialHappyEyeballs(ctx, network, interleaveFamilies(ips), port, timeout)
+}
+
+// filterFamily only ipv4 for tcp4 and udp4, only ipv6 for tcp6 and udp6
+func filterFamily(network string, ips []net.IP) []net.IP {
+	if !strings.HasSuffix(network, "4") && !strings.HasSuffix(network, "6") {
+		return ips
+	}
+	var matched []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == strings.HasSuffix(network, "4") {
+			matched = append(matched, ip)
+		}
+	}
+	return matched
+}
+
+// interleaveFamilies alternate ipv6 and ipv4 addresses, starting with the first family
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var first, second []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	result := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			result = append(result, first[i])
+		}
+		if i < len(second) {
+			result = append(result, second[i])
+		}
+	}
+	return result
+}
+
+// dialHappyEyeballs connect ips in order, a next one starts after a delay or a failure,
+// the first connected wins and the others are closed
+func dialHappyEyeballs(ctx context.Context, network string, ips []net.IP, port string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close the connections connected later
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			lastErr = r.err
+			if next < len(ips) {
+				start()
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,277 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS a stand-in nameserver answering A and SRV records
+type fakeDNS struct {
+	conn    net.PacketConn
+	queries int32
+
+	mu   sync.Mutex
+	a    map[string][4]byte
+	srvs map[string][]dnsmessage.SRVResource
+}
+
+func startFakeDNS(t *testing.T) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDNS{conn: conn, a: map[string][4]byte{}, srvs: map[string][]dnsmessage.SRVResource{}}
+	t.Cleanup(func() { conn.Close() })
+	go d.serve()
+	return d
+}
+
+func (d *fakeDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var req dnsmessage.Message
+		if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+			continue
+		}
+		atomic.AddInt32(&d.queries, 1)
+		q := req.Questions[0]
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: req.Header.ID, Response: true},
+			Questions: req.Questions,
+		}
+		header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 1}
+
+		d.mu.Lock()
+		switch q.Type {
+		case dnsmessage.TypeA:
+			if a, ok := d.a[q.Name.String()]; ok {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: a}})
+			}
+		case dnsmessage.TypeSRV:
+			for _, srv := range d.srvs[q.Name.String()] {
+				srv := srv
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &srv})
+			}
+		}
+		d.mu.Unlock()
+
+		packet, _ := resp.Pack()
+		d.conn.WriteTo(packet, addr)
+	}
+}
+
+func (d *fakeDNS) setA(name string, ip string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	d.a[name] = a
+}
+
+func TestResolverTTLCache(t *testing.T) {
+	d := startFakeDNS(t)
+	d.setA("svc.test.", "127.0.0.1")
+	r := newDNSResolver([]string{d.conn.LocalAddr().String()})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	ips, err := r.LookupIP(context.Background(), "svc.test")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("lookup: %v %v", ips, err)
+	}
+	queries := atomic.LoadInt32(&d.queries)
+	if _, err := r.LookupIP(context.Background(), "svc.test"); err != nil || atomic.LoadInt32(&d.queries) != queries {
+		t.Fatalf("not cached: %v, %d queries", err, atomic.LoadInt32(&d.queries))
+	}
+
+	// The answer changes after TTL
+	d.setA("svc.test.", "127.0.0.2")
+	now = now.Add(1100 * time.Millisecond)
+	ips, err = r.LookupIP(context.Background(), "svc.test")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("not refreshed: %v %v", ips, err)
+	}
+}
+
+func TestResolverCacheBound(t *testing.T) {
+	r := newDNSResolver(nil)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < dnsCacheSize; i++ {
+		r.store("ip "+strconv.Itoa(i), &dnsEntry{}, time.Duration(1+i%2)*time.Minute)
+	}
+	// Expired entries are dropped for a new one
+	now = now.Add(90 * time.Second)
+	r.store("ip new", &dnsEntry{}, time.Minute)
+	if n := len(r.cache); n != dnsCacheSize/2+1 {
+		t.Fatalf("%d entries cached, want %d", n, dnsCacheSize/2+1)
+	}
+
+	// A live entry is dropped when all are live
+	for i := 0; len(r.cache) < dnsCacheSize; i++ {
+		r.store("ip more "+strconv.Itoa(i), &dnsEntry{}, time.Minute)
+	}
+	r.store("ip last", &dnsEntry{}, time.Minute)
+	if n := len(r.cache); n != dnsCacheSize || r.cached("ip last") == nil {
+		t.Fatalf("%d entries cached, want %d with the last one", n, dnsCacheSize)
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// The first address refuses, the second one is connected
+	ips := []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}
+	conn, err := dialHappyEyeballs(context.Background(), "tcp", ips, port, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestSRVDialer(t *testing.T) {
+	d := startFakeDNS(t)
+	d.setA("svc.test.", "127.0.0.1")
+
+	var ports []uint16
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		listeners = append(listeners, l)
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		p, _ := strconv.Atoi(port)
+		ports = append(ports, uint16(p))
+	}
+	target := dnsmessage.MustNewName("svc.test.")
+	d.mu.Lock()
+	d.srvs["_echo._tcp.svc.test."] = []dnsmessage.SRVResource{
+		{Priority: 10, Weight: 1, Port: ports[0], Target: target},
+		{Priority: 20, Weight: 1, Port: ports[1], Target: target},
+	}
+	d.mu.Unlock()
+
+	saved := getResolver()
+	defaultResolver = newDNSResolver([]string{d.conn.LocalAddr().String()})
+	t.Cleanup(func() { defaultResolver = saved })
+
+	a, err := ResolveAddr("srv://_echo._tcp.svc.test?connect_timeout=1s")
+	if err != nil || !a.IsTCP || a.SRV != "_echo._tcp.svc.test" {
+		t.Fatalf("resolve: %+v %v", a, err)
+	}
+	dialer := &ProxyTunnelSRVDialer{}
+	dialer.SetAddr(a)
+
+	dialTo := func() string {
+		conn, err := dialer.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.RemoteAddr().String()
+	}
+
+	// The lowest priority first, the next one if it fails
+	if addr := dialTo(); addr != listeners[0].Addr().String() {
+		t.Fatalf("connected %s, want %s", addr, listeners[0].Addr())
+	}
+	listeners[0].Close()
+	if addr := dialTo(); addr != listeners[1].Addr().String() {
+		t.Fatalf("connected %s, want %s", addr, listeners[1].Addr())
+	}
+}
+
+// useHostsResolver the default resolver reads hosts from a file of the lines until the test ends
+func useHostsResolver(t *testing.T, servers []string, lines string) string {
+	t.Helper()
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hosts, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	saved := getResolver()
+	defaultResolver = newDNSResolver(servers)
+	defaultResolver.hostsFile = hosts
+	t.Cleanup(func() { defaultResolver = saved })
+	return hosts
+}
+
+// rewriteHosts write the hosts file with a new modification time
+func rewriteHosts(t *testing.T, hosts, lines string) {
+	t.Helper()
+	if err := os.WriteFile(hosts, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(hosts, later, later)
+}
+
+func TestResolverHostsFirst(t *testing.T) {
+	d := startFakeDNS(t)
+	d.setA("svc.test.", "127.0.0.1")
+	hosts := useHostsResolver(t, []string{d.conn.LocalAddr().String()}, "# local names\n127.0.0.9 svc.test svc # alias\n::1 svc.test\n")
+	r := getResolver()
+
+	ips, err := r.LookupIP(context.Background(), "SVC.test")
+	if err != nil || len(ips) != 2 || !ips[0].Equal(net.ParseIP("127.0.0.9")) || !ips[1].Equal(net.IPv6loopback) {
+		t.Fatalf("lookup: %v %v", ips, err)
+	}
+	if ips, _ := r.LookupIP(context.Background(), "svc"); len(ips) != 1 {
+		t.Fatalf("alias: %v", ips)
+	}
+	if n := atomic.LoadInt32(&d.queries); n != 0 {
+		t.Fatalf("%d queries of a name in hosts", n)
+	}
+
+	// A changed hosts file is read again, a name not in it is asked to nameservers
+	rewriteHosts(t, hosts, "127.0.0.8 other.test\n")
+	ips, err = r.LookupIP(context.Background(), "svc.test")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("lookup after change: %v %v", ips, err)
+	}
+}
+
+func TestResolverContext(t *testing.T) {
+	// A nameserver never answering
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	r := newDNSResolver([]string{silent.LocalAddr().String()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if ips, err := r.LookupIP(ctx, "slow.test"); err == nil {
+		t.Fatalf("lookup: %v", ips)
+	}
+	if d := time.Since(start); d > dnsQueryTimeout/2 {
+		t.Fatalf("lookup returned after %s", d)
+	}
+	// The canceled lookup is not cached as a failure of the name
+	if r.cached("ip slow.test") != nil {
+		t.Fatal("canceled lookup cached")
+	}
+}
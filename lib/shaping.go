@@ -0,0 +1,301 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Shaping bandwidth and quotas of a tunnel, like:
+//
+//	shaping:
+//	  upload: 1048576
+//	  download: 4194304
+//	  client_upload: 262144
+//	  client_download: 1048576
+//	  quota: 107374182400
+//	  client_quota: 10737418240
+//
+// Rates are bytes per second by token buckets, upload from clients to upstream, download
+// back, of the tunnel and of every client ip. A stream waits for tokens, a udp datagram
+// without tokens is dropped. Quotas are bytes in both directions since started, over quota
+// the connections are closed and new ones are refused, datagrams are dropped.
+// Buckets of a client without connections are dropped after shaperClientIdle, only its
+// bytes are kept if client_quota is set.
+
+// shaperClientIdle drop the buckets of a client idle for it
+const shaperClientIdle = time.Minute
+
+// errQuotaExceeded bytes over quota of tunnel or client
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Shaping rates and quotas in bytes, zero is unlimited
+type Shaping struct {
+	Upload         int64 `mapstructure:"upload"`
+	Download       int64 `mapstructure:"download"`
+	ClientUpload   int64 `mapstructure:"client_upload"`
+	ClientDownload int64 `mapstructure:"client_download"`
+	Quota          int64 `mapstructure:"quota"`
+	ClientQuota    int64 `mapstructure:"client_quota"`
+}
+
+// Validate check rates and quotas
+func (s *Shaping) Validate() error {
+	if s.Upload < 0 || s.Download < 0 || s.ClientUpload < 0 || s.ClientDownload < 0 || s.Quota < 0 || s.ClientQuota < 0 {
+		return errors.New("should not be negative")
+	}
+	return nil
+}
+
+// tokenBucket rate of bytes, tokens may be borrowed and paid back by waiting
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket bytes per second with a burst of 100ms, nil if unlimited
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(float64(rate)/10, 1)
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// refill under lock
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// reserve take n tokens, how long to wait for them
+func (b *tokenBucket) reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limit n to the burst of bucket, a read never takes more than the bucket holds
+func (b *tokenBucket) limit(n int) int {
+	if b == nil || float64(n) <= b.burst {
+		return n
+	}
+	return int(b.burst)
+}
+
+// ready any tokens left now
+func (b *tokenBucket) ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens > 0
+}
+
+// clientShaper buckets and bytes of a client ip
+type clientShaper struct {
+	upload   *tokenBucket
+	download *tokenBucket
+	used     int64
+
+	// refs connections of the client, last time one released or a datagram, under lock of shaper
+	refs int
+	last time.Time
+}
+
+// shaper buckets and quotas of a tunnel
+type shaper struct {
+	shaping  Shaping
+	upload   *tokenBucket
+	download *tokenBucket
+	used     int64
+
+	mu      sync.Mutex
+	clients map[string]*clientShaper
+	// quotaUsed bytes of clients dropped, kept for client_quota
+	quotaUsed map[string]int64
+	swept     time.Time
+
+	uploaded   *Counter
+	downloaded *Counter
+	dropped    *Counter
+	exceeded   *Counter
+}
+
+// newShaper the shaper of tunnel, nil if not shaped
+func newShaper(tunnel string, s *Shaping) *shaper {
+	if s == nil || *s == (Shaping{}) {
+		return nil
+	}
+	return &shaper{
+		shaping:    *s,
+		upload:     newTokenBucket(s.Upload),
+		download:   newTokenBucket(s.Download),
+		clients:    make(map[string]*clientShaper),
+		quotaUsed:  make(map[string]int64),
+		swept:      time.Now(),
+		uploaded:   GetCounter(tunnel + ".upload_bytes"),
+		downloaded: GetCounter(tunnel + ".download_bytes"),
+		dropped:    GetCounter(tunnel + ".shaped_drops"),
+		exceeded:   GetCounter(tunnel + ".quota_exceeded"),
+	}
+}
+
+// client the shaper of client ip, unix clients share one, release it when the connection is closed
+func (s *shaper) client(addr net.Addr) *clientShaper {
+	key := limitKey(addr)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) >= shaperClientIdle {
+		s.sweep(now)
+	}
+	cs, ok := s.clients[key]
+	if !ok {
+		cs = &clientShaper{upload: newTokenBucket(s.shaping.ClientUpload), download: newTokenBucket(s.shaping.ClientDownload)}
+		if used, ok := s.quotaUsed[key]; ok {
+			cs.used = used
+			delete(s.quotaUsed, key)
+		}
+		s.clients[key] = cs
+	}
+	cs.refs++
+	return cs
+}
+
+// release a connection of client
+func (s *shaper) release(cs *clientShaper) {
+	s.mu.Lock()
+	cs.refs--
+	cs.last = time.Now()
+	s.mu.Unlock()
+}
+
+// sweep drop clients idle without connections, under lock
+func (s *shaper) sweep(now time.Time) {
+	s.swept = now
+	for key, cs := range s.clients {
+		if cs.refs > 0 || now.Sub(cs.last) < shaperClientIdle {
+			continue
+		}
+		if used := atomic.LoadInt64(&cs.used); s.shaping.ClientQuota > 0 && used > 0 {
+			s.quotaUsed[key] = used
+		}
+		delete(s.clients, key)
+	}
+}
+
+// admit check quotas before a connection
+func (s *shaper) admit(cs *clientShaper) error {
+	if s.shaping.Quota > 0 && atomic.LoadInt64(&s.used) >= s.shaping.Quota ||
+		s.shaping.ClientQuota > 0 && atomic.LoadInt64(&cs.used) >= s.shaping.ClientQuota {
+		s.exceeded.Add(1)
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// count n bytes to quotas
+func (s *shaper) count(cs *clientShaper, n int, upload bool) {
+	atomic.AddInt64(&s.used, int64(n))
+	atomic.AddInt64(&cs.used, int64(n))
+	if upload {
+		s.uploaded.Add(int64(n))
+	} else {
+		s.downloaded.Add(int64(n))
+	}
+}
+
+// buckets of a direction
+func (s *shaper) buckets(cs *clientShaper, upload bool) (*tokenBucket, *tokenBucket) {
+	if upload {
+		return s.upload, cs.upload
+	}
+	return s.download, cs.download
+}
+
+// readSize at most n bytes of a stream read at once, by the bursts of a direction
+func (s *shaper) readSize(cs *clientShaper, n int, upload bool) int {
+	tb, cb := s.buckets(cs, upload)
+	return cb.limit(tb.limit(n))
+}
+
+// wait n bytes of a stream until ctx is done, error if over quota after them
+func (s *shaper) wait(ctx context.Context, cs *clientShaper, n int, upload bool) error {
+	tb, cb := s.buckets(cs, upload)
+	delay := tb.reserve(n)
+	if d := cb.reserve(n); d > delay {
+		delay = d
+	}
+	s.count(cs, n, upload)
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return s.admit(cs)
+}
+
+// allowDatagram take tokens of a datagram, false to drop it
+func (s *shaper) allowDatagram(client net.Addr, n int, upload bool) bool {
+	cs := s.client(client)
+	defer s.release(cs)
+	tb, cb := s.buckets(cs, upload)
+	if s.admit(cs) != nil || !tb.ready() || !cb.ready() {
+		s.dropped.Add(1)
+		return false
+	}
+	tb.reserve(n)
+	cb.reserve(n)
+	s.count(cs, n, upload)
+	return true
+}
+
+// shapedConn read from the connection by the rate of a direction
+type shapedConn struct {
+	net.Conn
+	s      *shaper
+	cs     *clientShaper
+	upload bool
+	// ctx stop waiting for tokens
+	ctx context.Context
+}
+
+// CloseWrite half-close the connection under
+func (c *shapedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *shapedConn) Read(b []byte) (int, error) {
+	// Bytes over a burst are left in the socket, not read and held back
+	n, err := c.Conn.Read(b[:c.s.readSize(c.cs, len(b), c.upload)])
+	if n > 0 {
+		if qerr := c.s.wait(c.ctx, c.cs, n, c.upload); qerr != nil && err == nil {
+			err = qerr
+		}
+	}
+	return n, err
+}
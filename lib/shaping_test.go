@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShaperEvictIdleClients(t *testing.T) {
+	s := newShaper(t.Name(), &Shaping{ClientUpload: 1000})
+	active := s.client(testClient("10.0.0.1"))
+	idle := s.client(testClient("10.0.0.2"))
+	s.release(idle)
+	s.allowDatagram(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 3)}, 10, true)
+
+	// Not idle long enough
+	s.client(testClient("10.0.0.4"))
+	if len(s.clients) != 4 {
+		t.Fatalf("%d clients", len(s.clients))
+	}
+
+	s.mu.Lock()
+	s.swept = time.Now().Add(-2 * shaperClientIdle)
+	for _, cs := range s.clients {
+		cs.last = time.Now().Add(-2 * shaperClientIdle)
+	}
+	s.mu.Unlock()
+	s.client(testClient("10.0.0.5"))
+	if len(s.clients) != 3 || s.clients["10.0.0.1"] != active || s.clients["10.0.0.2"] != nil || len(s.quotaUsed) != 0 {
+		t.Fatalf("clients after sweep: %v, used %v", s.clients, s.quotaUsed)
+	}
+}
+
+func TestShaperKeepClientQuota(t *testing.T) {
+	s := newShaper(t.Name(), &Shaping{ClientQuota: 100})
+	cs := s.client(testClient("10.0.0.1"))
+	s.count(cs, 100, true)
+	s.release(cs)
+
+	s.mu.Lock()
+	cs.last = time.Now().Add(-2 * shaperClientIdle)
+	s.sweep(time.Now())
+	s.mu.Unlock()
+	if len(s.clients) != 0 || s.quotaUsed["10.0.0.1"] != 100 {
+		t.Fatalf("clients %v, used %v", s.clients, s.quotaUsed)
+	}
+
+	// The bytes come back with the client
+	cs = s.client(testClient("10.0.0.1"))
+	defer s.release(cs)
+	if err := s.admit(cs); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("error %v, want quota exceeded", err)
+	}
+	if len(s.quotaUsed) != 0 {
+		t.Fatalf("used %v kept", s.quotaUsed)
+	}
+}
+
+func TestShapedReadStopped(t *testing.T) {
+	s := newShaper(t.Name(), &Shaping{Upload: 100})
+	client, server := tcpPair(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cs := s.client(client.RemoteAddr())
+	defer s.release(cs)
+	conn := &shapedConn{Conn: server, s: s, cs: cs, upload: true, ctx: ctx}
+
+	// 1000 bytes wait about 9s for tokens of 100 bytes per second
+	client.Write(make([]byte, 1000))
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	total := 0
+	var err error
+	for err == nil {
+		var n int
+		n, err = conn.Read(make([]byte, 1000))
+		total += n
+	}
+	if total == 0 || total >= 1000 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("read %d %v, want canceled", total, err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("read stopped after %s", d)
+	}
+}
+
+func TestShapedReadBurst(t *testing.T) {
+	const rate = 20000
+	s := newShaper(t.Name(), &Shaping{Download: rate})
+	burst := int(s.download.burst)
+	client, server := tcpPair(t)
+	cs := s.client(client.RemoteAddr())
+	defer s.release(cs)
+	conn := &shapedConn{Conn: server, s: s, cs: cs, ctx: context.Background()}
+
+	const size = 10000
+	go client.Write(make([]byte, size))
+
+	// Bytes read by any time are at most a burst over the rate since start
+	start := time.Now()
+	total := 0
+	buf := make([]byte, 32*1024)
+	for total < size {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > burst {
+			t.Fatalf("read %d bytes at once, burst %d", n, burst)
+		}
+		total += n
+		if allowed := burst + int(time.Since(start).Seconds()*rate); total > allowed+burst/10 {
+			t.Fatalf("%d bytes read in %s, at most %d", total, time.Since(start), allowed)
+		}
+	}
+	// And the average keeps the rate
+	if d := time.Since(start); d < time.Duration(float64(size-burst)/rate*float64(time.Second))*9/10 {
+		t.Fatalf("%d bytes read in %s", size, d)
+	}
+}
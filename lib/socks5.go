@@ -0,0 +1,480 @@
+package lib
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 (RFC 1928) server, the destination comes from client, like:
+//
+//	proxysocket "socks5://0.0.0.0:1080?user=alice&pass=secret"
+//
+// CONNECT is proxied as tcp, UDP ASSOCIATE is proxied by udp dialer,
+// username/password auth (RFC 1929) is required when user is given.
+
+const (
+	socks5Version        = 0x05
+	socks5AuthVersion    = 0x01
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5AuthNoAccept   = 0xff
+	socks5CmdConnect     = 0x01
+	socks5CmdAssociate   = 0x03
+	socks5AtypIPv4       = 0x01
+	socks5AtypDomain     = 0x03
+	socks5AtypIPv6       = 0x04
+	socks5Succeeded      = 0x00
+	socks5Failure        = 0x01
+	socks5NetUnreach     = 0x03
+	socks5HostUnreach    = 0x04
+	socks5ConnRefused    = 0x05
+	socks5TTLExpired     = 0x06
+	socks5CmdNotSupport  = 0x07
+	socks5AtypNotSupport = 0x08
+
+	socks5HandshakeTimeout = 10 * time.Second
+	// socks5MaxDests destinations of an udp association kept, a random one is dropped for more
+	socks5MaxDests = 256
+)
+
+// errSOCKS5Atyp an address type not supported
+var errSOCKS5Atyp = errors.New("unsupported socks address type")
+
+// socks5ReplyOf the reply code of a failure connecting the destination
+func socks5ReplyOf(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5NetUnreach
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks5HostUnreach
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return socks5TTLExpired
+	}
+	return socks5Failure
+}
+
+// NewProxyTunnelSOCKS5Server new a tcp server negotiating socks5 with clients
+func NewProxyTunnelSOCKS5Server(addr *ProxyProtoAddr) ProxyTunnelServer {
+	s := NewProxyTunnelTCPServer().(*ProxyTunnelTCPServer)
+	user, pass := addr.Options.Get("user"), addr.Options.Get("pass")
+	s.handshake = func(ctx context.Context, conn net.Conn, ch chan<- *ProxyChainConn) (*ProxyChainConn, error) {
+		return socks5Handshake(ctx, conn, ch, user, pass)
+	}
+	return s
+}
+
+// socks5Handshake negotiate auth and request, CONNECT returns a connection waiting reply
+func socks5Handshake(ctx context.Context, conn net.Conn, ch chan<- *ProxyChainConn, user, pass string) (*ProxyChainConn, error) {
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	// VER NMETHODS METHODS
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported socks version %d", buf[0])
+	}
+	methods := buf[1:1]
+	if n := int(buf[1]); n > 0 {
+		if _, err := io.ReadFull(conn, buf[2:2+n]); err != nil {
+			return nil, err
+		}
+		methods = buf[2 : 2+n]
+	}
+
+	method := byte(socks5AuthNone)
+	if user != "" {
+		method = socks5AuthPassword
+	}
+	accepted := false
+	for _, m := range methods {
+		if m == method {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return nil, errors.New("no acceptable socks auth method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+
+	if method == socks5AuthPassword {
+		if err := socks5Auth(conn, user, pass); err != nil {
+			return nil, err
+		}
+	}
+
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return nil, err
+	}
+	cmd := buf[1]
+	dest, err := readSOCKS5Addr(conn)
+	if err != nil {
+		if errors.Is(err, errSOCKS5Atyp) {
+			writeSOCKS5Reply(conn, socks5AtypNotSupport, nil)
+		} else {
+			writeSOCKS5Reply(conn, socks5Failure, nil)
+		}
+		return nil, err
+	}
+
+	switch cmd {
+	case socks5CmdConnect:
+		to, err := newDestAddr("tcp", dest)
+		if err != nil {
+			writeSOCKS5Reply(conn, socks5HostUnreach, nil)
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		log.Infof("socks5 connect from %s to %s", conn.RemoteAddr(), dest)
+		c := &ProxyChainConn{inConn: conn, Dest: to}
+		c.connected = func(outConn net.Conn, err error) error {
+			if err != nil {
+				return writeSOCKS5Reply(conn, socks5ReplyOf(err), nil)
+			}
+			return writeSOCKS5Reply(conn, socks5Succeeded, outConn.LocalAddr())
+		}
+		return c, nil
+	case socks5CmdAssociate:
+		return nil, socks5Associate(ctx, conn, ch)
+	default:
+		writeSOCKS5Reply(conn, socks5CmdNotSupport, nil)
+		return nil, fmt.Errorf("unsupported socks command %d", cmd)
+	}
+}
+
+// socks5Auth check username and password
+func socks5Auth(conn net.Conn, user, pass string) error {
+	// VER ULEN UNAME PLEN PASSWD
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socks5AuthVersion {
+		return fmt.Errorf("unsupported socks auth version %d", buf[0])
+	}
+	u := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, u); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return err
+	}
+	p := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, p); err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(u, []byte(user)) != 1 || subtle.ConstantTimeCompare(p, []byte(pass)) != 1 {
+		conn.Write([]byte{socks5AuthVersion, 0x01})
+		return errors.New("socks auth failed of user: " + string(u))
+	}
+	_, err := conn.Write([]byte{socks5AuthVersion, 0x00})
+	return err
+}
+
+// socks5Associate relay udp datagrams of the client until the control connection is closed,
+// or the tunnel is stopped
+func socks5Associate(ctx context.Context, conn net.Conn, ch chan<- *ProxyChainConn) error {
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	client, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if local == nil || client == nil {
+		writeSOCKS5Reply(conn, socks5Failure, nil)
+		return errors.New("udp associate only on tcp")
+	}
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5Failure, nil)
+		return err
+	}
+	if err := writeSOCKS5Reply(conn, socks5Succeeded, udp.LocalAddr()); err != nil {
+		udp.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	log.Infof("socks5 udp associate from %s on %s", conn.RemoteAddr(), udp.LocalAddr())
+
+	// The association terminates when the control connection closes
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		udp.Close()
+	}()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+	dests := make(map[string]*socks5UDPDest)
+	buf := make([]byte, 65535)
+	for {
+		size, from, err := udp.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		if !from.IP.Equal(client.IP) {
+			log.Warnf("drop socks5 udp from %s, not the client %s", from, client.IP)
+			continue
+		}
+
+		dest, data, err := parseSOCKS5UDP(buf[:size])
+		if err != nil {
+			log.Warnf("drop socks5 udp from %s: %s", from, err)
+			continue
+		}
+		to, ok := dests[dest]
+		if !ok {
+			// A hostname is resolved when dialing, out of this loop
+			to, err = newSOCKS5UDPDest(dest)
+			if err != nil {
+				log.Warnf("drop socks5 udp from %s to %s: %s", from, dest, err)
+				continue
+			}
+			if len(dests) >= socks5MaxDests {
+				for old := range dests {
+					delete(dests, old)
+					break
+				}
+			}
+			dests[dest] = to
+		}
+
+		c := &ProxyChainConn{
+			inConn:          &socks5UDPConn{UDPConn: udp, header: to.header},
+			InUDPRemoteAddr: from,
+			UDPData:         append([]byte(nil), data...),
+			Dest:            to.addr,
+		}
+		if !deliver(ctx, ch, c) {
+			break
+		}
+	}
+
+	log.Infof("socks5 udp associate from %s closed", conn.RemoteAddr())
+	conn.Close()
+	return nil
+}
+
+// socks5UDPDest a destination of udp association and the header of its replies
+type socks5UDPDest struct {
+	addr   *ProxyProtoAddr
+	header []byte
+}
+
+// newSOCKS5UDPDest the destination of host:port, the reply header carries it as the client sent
+func newSOCKS5UDPDest(dest string) (*socks5UDPDest, error) {
+	addr, err := newDestAddr("udp", dest)
+	if err != nil {
+		return nil, err
+	}
+	// RSV FRAG ATYP DST.ADDR DST.PORT
+	header, err := appendSOCKS5Host([]byte{0, 0, 0}, addr.Host)
+	if err != nil {
+		return nil, err
+	}
+	return &socks5UDPDest{addr: addr, header: header}, nil
+}
+
+// socks5UDPConn add socks5 udp header to the datagrams back to client
+type socks5UDPConn struct {
+	*net.UDPConn
+	header []byte
+}
+
+// WriteToUDP write a datagram with the header of the replying address
+func (c *socks5UDPConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	n, err := c.UDPConn.WriteToUDP(append(append([]byte(nil), c.header...), b...), addr)
+	if n -= len(c.header); n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// parseSOCKS5UDP split the udp header and data
+func parseSOCKS5UDP(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("short socks5 udp header")
+	}
+	if b[2] != 0 {
+		return "", nil, errors.New("not support socks5 udp fragment")
+	}
+	r := &byteReader{b: b[3:]}
+	dest, err := readSOCKS5Addr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return dest, r.b, nil
+}
+
+// byteReader read from a byte slice, the rest is left in b
+type byteReader struct {
+	b []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// readSOCKS5Addr read ATYP DST.ADDR DST.PORT as host:port
+func readSOCKS5Addr(r io.Reader) (string, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch buf[0] {
+	case socks5AtypIPv4:
+		if _, err := io.ReadFull(r, buf[:net.IPv4len]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case socks5AtypIPv6:
+		if _, err := io.ReadFull(r, buf[:net.IPv6len]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	case socks5AtypDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return "", err
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return "", err
+		}
+		host = string(buf[:n])
+	default:
+		return "", fmt.Errorf("%w %d", errSOCKS5Atyp, buf[0])
+	}
+
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// appendSOCKS5Addr append ATYP BND.ADDR BND.PORT, a non ip address is 0.0.0.0:0
+func appendSOCKS5Addr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, socks5AtypIPv4), ip4...)
+	} else if ip != nil {
+		b = append(append(b, socks5AtypIPv6), ip.To16()...)
+	} else {
+		b = append(b, socks5AtypIPv4, 0, 0, 0, 0)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// writeSOCKS5Reply VER REP RSV ATYP BND.ADDR BND.PORT
+func writeSOCKS5Reply(conn net.Conn, rep byte, bind net.Addr) error {
+	_, err := conn.Write(appendSOCKS5Addr([]byte{socks5Version, rep, 0}, bind))
+	return err
+}
+
+// socks5Connect ask a socks5 proxy on conn to connect the target host:port
+func socks5Connect(conn net.Conn, target, user, pass string) error {
+	methods := []byte{socks5Version, 1, socks5AuthNone}
+	if user != "" {
+		methods = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	switch buf[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("socks5 user or pass too long")
+		}
+		auth := append([]byte{socks5AuthVersion, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("socks5 auth failed of user: " + user)
+		}
+	default:
+		return errors.New("no acceptable socks5 auth method")
+	}
+
+	req, err := appendSOCKS5Host([]byte{socks5Version, socks5CmdConnect, 0}, target)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP BND.ADDR BND.PORT
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return err
+	}
+	if buf[1] != socks5Succeeded {
+		return fmt.Errorf("socks5 connect %s failed, reply %d", target, buf[1])
+	}
+	_, err = readSOCKS5Addr(conn)
+	return err
+}
+
+// appendSOCKS5Host append ATYP DST.ADDR DST.PORT of host:port, a name is sent as domain
+func appendSOCKS5Host(b []byte, hostport string) ([]byte, error) {
+	host, portstr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errors.New("socks5 domain too long: " + host)
+		}
+		b = append(append(b, socks5AtypDomain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, socks5AtypIPv4), ip4...)
+	} else {
+		b = append(append(b, socks5AtypIPv6), ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
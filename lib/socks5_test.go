@@ -0,0 +1,251 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSOCKS5Connect(t *testing.T) {
+	echo := startEcho(t)
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{InAddr: "socks5://" + in})
+
+	conn, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := socks5Connect(conn, echo.Addr().String(), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := roundTrip(t, conn, "hello"); got != "hello" {
+		t.Fatalf("echo %q", got)
+	}
+
+	// The dialer of a destination from handshake is not kept
+	to, _ := ResolveAddr("tcp://" + echo.Addr().String())
+	AllDialerPools.mu.Lock()
+	_, kept := AllDialerPools.dialerpool[dialerKey(to)]
+	AllDialerPools.mu.Unlock()
+	if kept {
+		t.Fatalf("dialer of %s kept in pools", to.Addr)
+	}
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	echo := startEcho(t)
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{InAddr: "socks5://" + in + "?user=alice&pass=secret"})
+
+	tests := []struct {
+		user, pass string
+		err        string
+	}{
+		{"alice", "secret", ""},
+		{"alice", "wrong", "auth failed"},
+		{"bob", "secret", "auth failed"},
+		{"", "", "no acceptable"},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		err = socks5Connect(conn, echo.Addr().String(), tt.user, tt.pass)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("user %q pass %q: error %v, want %q", tt.user, tt.pass, err, tt.err)
+		}
+		conn.Close()
+	}
+}
+
+func TestSOCKS5ConnectRefused(t *testing.T) {
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{InAddr: "socks5://" + in})
+
+	conn, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	err = socks5Connect(conn, freeAddr(t, "tcp"), "", "")
+	if err == nil || !strings.Contains(err.Error(), "reply 5") {
+		t.Fatalf("error %v, want reply 5", err)
+	}
+}
+
+func TestSOCKS5HandshakeInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		reply   []byte
+		err     string
+	}{
+		{"version", []byte{4, 1, 0}, nil, "unsupported socks version"},
+		{"no method", []byte{5, 1, socks5AuthPassword}, []byte{5, socks5AuthNoAccept}, "no acceptable"},
+		{"command", []byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 80}, []byte{5, 0, 5, socks5CmdNotSupport}, "unsupported socks command"},
+		{"address type", []byte{5, 1, 0, 5, 1, 0, 9}, []byte{5, 0, 5, socks5AtypNotSupport}, "unsupported socks address type"},
+		{"short", []byte{5, 1, 0, 5, 1, 0, 1, 127}, []byte{5, 0, 5, socks5Failure}, "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			client.Write(tt.request)
+			client.(*net.TCPConn).CloseWrite()
+
+			c, err := socks5Handshake(context.Background(), server, nil, "", "")
+			if c != nil || err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("handshake %v %v, want error %q", c, err, tt.err)
+			}
+			server.Close()
+			reply := make([]byte, 64)
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, _ := client.Read(reply)
+			if !bytes.HasPrefix(reply[:n], tt.reply) {
+				t.Fatalf("reply %v, want prefix %v", reply[:n], tt.reply)
+			}
+		})
+	}
+}
+
+func TestSOCKS5HandshakeDomain(t *testing.T) {
+	client, server := tcpPair(t)
+	request := []byte{5, 1, 0, 5, 1, 0, socks5AtypDomain, 9}
+	request = append(append(request, "localhost"...), 1, 187)
+	client.Write(request)
+
+	c, err := socks5Handshake(context.Background(), server, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Dest == nil || c.Dest.Host != "localhost:443" || !c.Dest.IsTCP {
+		t.Fatalf("destination %+v", c.Dest)
+	}
+}
+
+func TestSOCKS5HandshakeDomainOptions(t *testing.T) {
+	// A domain is a host of destination, never options of the address
+	for _, domain := range []string{"x]:1?pool_min_idle=7&z=[", "a/b?tls=1", "u@host", "h?mux=1"} {
+		client, server := tcpPair(t)
+		request := append([]byte{5, 1, 0, 5, 1, 0, socks5AtypDomain, byte(len(domain))}, domain...)
+		client.Write(append(request, 0, 80))
+
+		// A domain not joined back to host:port is refused
+		c, err := socks5Handshake(context.Background(), server, nil, "", "")
+		if err != nil {
+			if strings.Contains(domain, ":") {
+				continue
+			}
+			t.Fatalf("%s: %v", domain, err)
+		}
+		if want := net.JoinHostPort(domain, "80"); c.Dest.Host != want || len(c.Dest.Options) != 0 || !c.Dest.IsTCP {
+			t.Fatalf("%s: destination %q options %v", domain, c.Dest.Host, c.Dest.Options)
+		}
+	}
+}
+
+func TestSOCKS5ReplyOf(t *testing.T) {
+	tests := []struct {
+		err   error
+		reply byte
+	}{
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, socks5ConnRefused},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, socks5NetUnreach},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, socks5HostUnreach},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nowhere.test", IsNotFound: true}}, socks5HostUnreach},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, socks5HostUnreach},
+		{context.DeadlineExceeded, socks5TTLExpired},
+		{&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, socks5TTLExpired},
+		{errors.New("no upstream"), socks5Failure},
+	}
+	for _, tt := range tests {
+		if reply := socks5ReplyOf(tt.err); reply != tt.reply {
+			t.Errorf("%v: reply %d, want %d", tt.err, reply, tt.reply)
+		}
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	echo := startUDPEcho(t)
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{InAddr: "socks5://" + in})
+
+	conn, err := net.Dial("tcp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{5, 1, 0})
+	conn.Write([]byte{5, socks5CmdAssociate, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 2)
+	if _, err := conn.Read(reply); err != nil || reply[1] != socks5AuthNone {
+		t.Fatalf("method reply %v %v", reply, err)
+	}
+	if _, err := conn.Read(reply[:2]); err != nil || reply[1] != socks5Succeeded {
+		t.Fatalf("associate reply %v %v", reply, err)
+	}
+	conn.Read(make([]byte, 1))
+	relay, err := readSOCKS5Addr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udp, err := net.Dial("udp", relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	header := appendSOCKS5Addr([]byte{0, 0, 0}, echo.LocalAddr())
+	udp.Write(append(header, "ping"...))
+
+	buf := make([]byte, 1500)
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := udp.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, data, err := parseSOCKS5UDP(buf[:n])
+	if err != nil || dest != echo.LocalAddr().String() || string(data) != "ping" {
+		t.Fatalf("reply from %s: %q %v", dest, data, err)
+	}
+}
+
+func TestParseSOCKS5UDP(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		dest   string
+		data   string
+		err    string
+	}{
+		{[]byte{0, 0, 0, 1, 10, 0, 0, 1, 0, 53, 'h', 'i'}, "10.0.0.1:53", "hi", ""},
+		{append(append([]byte{0, 0, 0, 3, 4}, "a.io"...), 0, 53, 'h', 'i'), "a.io:53", "hi", ""},
+		{[]byte{0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53}, "[::1]:53", "", ""},
+		{[]byte{0, 0, 0}, "", "", "short"},
+		{[]byte{0, 0, 1, 1, 10, 0, 0, 1, 0, 53}, "", "", "fragment"},
+		{[]byte{0, 0, 0, 1, 10, 0}, "", "", "EOF"},
+		{[]byte{0, 0, 0, 3, 9, 'a'}, "", "", "EOF"},
+	}
+	for _, tt := range tests {
+		dest, data, err := parseSOCKS5UDP(tt.packet)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parse %v: error %v, want %q", tt.packet, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || dest != tt.dest || string(data) != tt.data {
+			t.Errorf("parse %v: %s %q %v", tt.packet, dest, data, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"bufio"
+	"net"
+)
+
+// Zero-copy relay: io.Copy from a *net.TCPConn to a *net.TCPConn (ReadFrom) or to a stream
+// *net.UnixConn (WriteTo), or from a stream *net.UnixConn to a *net.TCPConn, moves data in
+// kernel by splice through a pipe on linux, without copying to user space. Wrappers like
+// pooled, group or PROXY protocol connections hide them, so the relay unwraps both
+// connections first, and writes the bytes the wrappers read ahead before. A shaped tunnel
+// counts every read, its connections are not unwrapped.
+
+// connWrapper a connection wrapping another one, only reading may be buffered
+type connWrapper interface {
+	// unwrap the bytes read ahead and not read yet, and the connection under,
+	// the wrapper should not be read after it
+	unwrap() ([]byte, net.Conn)
+}
+
+// unwrapConn the innermost connection for copying data, and the bytes read ahead by wrappers
+func unwrapConn(conn net.Conn) ([]byte, net.Conn) {
+	var pending []byte
+	for {
+		w, ok := conn.(connWrapper)
+		if !ok {
+			return pending, conn
+		}
+		// Bytes of the outer wrapper were read earlier from the inner one
+		var b []byte
+		b, conn = w.unwrap()
+		pending = append(pending, b...)
+	}
+}
+
+// unwrapReader the bytes buffered by a reader, they are taken
+func unwrapReader(r *bufio.Reader) []byte {
+	b, _ := r.Peek(r.Buffered())
+	b = append([]byte(nil), b...)
+	r.Discard(len(b))
+	return b
+}
+
+func (c *replayConn) unwrap() ([]byte, net.Conn) {
+	b := c.b
+	c.b = nil
+	return b, c.Conn
+}
+
+func (c *bufferedConn) unwrap() ([]byte, net.Conn) {
+	return unwrapReader(c.r), c.Conn
+}
+
+func (c *proxyProtoConn) unwrap() ([]byte, net.Conn) {
+	return unwrapReader(c.r), c.Conn
+}
+
+func (c *groupConn) unwrap() ([]byte, net.Conn) {
+	return nil, c.Conn
+}
@@ -0,0 +1,113 @@
+//go:build linux
+// +build linux
+
+package lib
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// userConn hide ReadFrom and WriteTo of the connection, io.Copy copies through a buffer in user space
+type userConn struct {
+	net.Conn
+}
+
+func (c *userConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// cpuTime user and system time of the process
+func cpuTime(b *testing.B) int64 {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		b.Fatal(err)
+	}
+	return ru.Utime.Nano() + ru.Stime.Nano()
+}
+
+// BenchmarkRelay relay from a tcp client to a tcp or unix upstream, by splice and by copying in user space
+func BenchmarkRelay(b *testing.B) {
+	for _, network := range []string{"tcp", "unix"} {
+		for _, mode := range []string{"splice", "copy"} {
+			network, copying := network, mode == "copy"
+			b.Run("tcp-"+network+"/"+mode, func(b *testing.B) {
+				benchmarkRelay(b, network, copying)
+			})
+		}
+	}
+}
+
+func benchmarkRelay(b *testing.B, network string, copying bool) {
+	addr := "127.0.0.1:0"
+	if network == "unix" {
+		addr = filepath.Join(b.TempDir(), "upstream.sock")
+	}
+	upstream, err := net.Listen(network, addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer upstream.Close()
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			received <- -1
+			return
+		}
+		n, _ := io.Copy(io.Discard, conn)
+		conn.Close()
+		received <- n
+	}()
+
+	inbound, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer inbound.Close()
+	client, err := net.Dial("tcp", inbound.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	inConn, err := inbound.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	outConn, err := net.Dial(network, upstream.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	if copying {
+		inConn, outConn = &userConn{inConn}, &userConn{outConn}
+	}
+
+	c := &ProxyChainConn{inConn: inConn, outConn: outConn}
+	done := make(chan struct{})
+	go func() {
+		c.relay()
+		close(done)
+	}()
+
+	buf := make([]byte, 1<<20)
+	b.SetBytes(int64(len(buf)))
+	cpu := cpuTime(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	client.(*net.TCPConn).CloseWrite()
+	n := <-received
+	<-done
+	b.StopTimer()
+
+	if n != int64(b.N)*int64(len(buf)) {
+		b.Fatalf("upstream received %d bytes, want %d", n, int64(b.N)*int64(len(buf)))
+	}
+	b.ReportMetric(float64(cpuTime(b)-cpu)/float64(b.N), "cpu-ns/op")
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// tlsHandshakeTimeout limit the time of a tls handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// loadTLSConfig load tls options of address, like:
+// tls://0.0.0.0:443?cert=a.pem&key=a.key&cert=b.pem&key=b.key&client_ca=clients.pem
+// tls://db.internal:5433?ca=ca.pem&cert=c.pem&key=c.key&servername=db
+//
+// On a listening address, several cert and key pairs are selected by SNI of client hello,
+// the first pair is used when no one matches, and client_ca verifies client certificates.
+// On a dialing address, cert and key is the client certificate, ca verifies the server,
+// servername is the host of address by default, insecure skips the verification.
+func loadTLSConfig(addr string, options url.Values) (*tls.Config, error) {
+	certs, keys := options["cert"], options["key"]
+	if len(certs) != len(keys) {
+		return nil, errors.New("tls cert and key should be given in pairs")
+	}
+
+	c := &tls.Config{}
+	for i := range certs {
+		pair, err := tls.LoadX509KeyPair(certs[i], keys[i])
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = append(c.Certificates, pair)
+	}
+
+	if ca := options.Get("ca"); ca != "" {
+		pool, err := loadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+	if ca := options.Get("client_ca"); ca != "" {
+		pool, err := loadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	c.ServerName = options.Get("servername")
+	if c.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			c.ServerName = host
+		}
+	}
+
+	c.InsecureSkipVerify = options.Get("insecure") == "true"
+	return c, nil
+}
+
+// loadCertPool load certificates of a pem file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + file)
+	}
+	return pool, nil
+}
+
+// checkTLSRole the options fit a listening or dialing tls address
+func checkTLSRole(a *ProxyProtoAddr, listening bool) error {
+	if !a.IsTLS {
+		return nil
+	}
+	if listening && a.Options.Get("ca") != "" {
+		return errors.New("ca verifies the server of a dialing address, use client_ca to verify clients")
+	}
+	if listening && len(a.TLSConfig.Certificates) == 0 {
+		return errors.New("cert and key are required to listen in tls")
+	}
+	if !listening && a.Options.Get("client_ca") != "" {
+		return errors.New("client_ca verifies clients of a listening address, use ca to verify the server")
+	}
+	return nil
+}
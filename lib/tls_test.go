@@ -0,0 +1,274 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA a certificate authority issuing certificates into pem files of dir
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+// newTestCA a self-signed ca, its certificate is written to name.pem
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	t.Helper()
+	ca := &testCA{t: t, dir: dir}
+	ca.cert, ca.key = ca.issue(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	ca.file, _ = ca.write(name, ca.cert, ca.key)
+	return ca
+}
+
+// issue sign the template by parent, self-signed when parent is nil
+func (ca *testCA) issue(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert, key
+}
+
+// write the certificate to name.pem and the key to name.key
+func (ca *testCA) write(name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (certFile, keyFile string) {
+	ca.t.Helper()
+	certFile = filepath.Join(ca.dir, name+".pem")
+	keyFile = filepath.Join(ca.dir, name+".key")
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// leaf issue a server certificate of dns names, or a client certificate without names
+func (ca *testCA) leaf(name string, dnsNames ...string) (certFile, keyFile string) {
+	ca.t.Helper()
+	usage := x509.ExtKeyUsageClientAuth
+	if len(dnsNames) > 0 {
+		usage = x509.ExtKeyUsageServerAuth
+	}
+	cert, key := ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    dnsNames,
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+	}, ca.cert, ca.key)
+	return ca.write(name, cert, key)
+}
+
+// pool the ca as a root pool
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// tlsRoundTrip dial a tls inbound and echo a message, the error of handshake or reading
+func tlsRoundTrip(addr string, config *tls.Config) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		return err
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != "hello" {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func TestTLSInbound(t *testing.T) {
+	echo := startEcho(t)
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	aCert, aKey := ca.leaf("a", "a.test")
+	bCert, bKey := ca.leaf("b", "b.test")
+
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{
+		InAddr:  "tls://" + in + "?cert=" + aCert + "&key=" + aKey + "&cert=" + bCert + "&key=" + bKey,
+		OutAddr: "tcp://" + echo.Addr().String(),
+	})
+
+	// The certificate is selected by SNI, the first one without a match
+	for _, tt := range []struct{ serverName, peer string }{{"a.test", "a"}, {"b.test", "b"}, {"", "a"}} {
+		config := &tls.Config{ServerName: tt.serverName, RootCAs: ca.pool(), InsecureSkipVerify: tt.serverName == ""}
+		conn, err := tls.Dial("tcp", in, config)
+		if err != nil {
+			t.Fatalf("sni %q: %v", tt.serverName, err)
+		}
+		if cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != tt.peer {
+			t.Errorf("sni %q: certificate %s, want %s", tt.serverName, cn, tt.peer)
+		}
+		conn.Close()
+	}
+	if err := tlsRoundTrip(in, &tls.Config{ServerName: "b.test", RootCAs: ca.pool()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSInboundClientCA(t *testing.T) {
+	echo := startEcho(t)
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	clients := newTestCA(t, dir, "clients")
+	cert, key := ca.leaf("server", "server.test")
+	clientCert, clientKey := clients.leaf("client")
+	otherCert, otherKey := ca.leaf("other")
+
+	in := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{
+		InAddr:  "tls://" + in + "?cert=" + cert + "&key=" + key + "&client_ca=" + clients.file,
+		OutAddr: "tcp://" + echo.Addr().String(),
+	})
+
+	config := &tls.Config{ServerName: "server.test", RootCAs: ca.pool()}
+	if err := tlsRoundTrip(in, config); err == nil {
+		t.Fatal("client without a certificate accepted")
+	}
+
+	// The ca of server does not verify clients
+	other, _ := tls.LoadX509KeyPair(otherCert, otherKey)
+	config.Certificates = []tls.Certificate{other}
+	if err := tlsRoundTrip(in, config); err == nil {
+		t.Fatal("client of another ca accepted")
+	}
+
+	client, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Certificates = []tls.Certificate{client}
+	if err := tlsRoundTrip(in, config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSOutbound(t *testing.T) {
+	echo := startEcho(t)
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	other := newTestCA(t, dir, "other")
+	cert, key := ca.leaf("server", "db.test")
+
+	upstream := freeAddr(t, "tcp")
+	startTunnel(t, ProxyChainTunnel{
+		Name:    t.Name() + "/upstream",
+		InAddr:  "tls://" + upstream + "?cert=" + cert + "&key=" + key,
+		OutAddr: "tcp://" + echo.Addr().String(),
+	})
+
+	tests := []struct {
+		options string
+		ok      bool
+	}{
+		{"ca=" + ca.file + "&servername=db.test", true},
+		// The certificate has no name of the address host
+		{"ca=" + ca.file + "&servername=web.test", false},
+		{"ca=" + other.file + "&servername=db.test", false},
+		{"ca=" + other.file + "&insecure=true", true},
+	}
+	for i, tt := range tests {
+		in := freeAddr(t, "tcp")
+		startTunnel(t, ProxyChainTunnel{
+			Name:    t.Name() + "/" + string(rune('a'+i)),
+			InAddr:  "tcp://" + in,
+			OutAddr: "tls://" + upstream + "?" + tt.options,
+		})
+
+		conn, err := net.Dial("tcp", in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "hello")
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		conn.Close()
+		if ok := err == nil && string(buf) == "hello"; ok != tt.ok {
+			t.Errorf("%s: relayed %v, want %v (%v)", tt.options, ok, tt.ok, err)
+		}
+	}
+}
+
+func TestTLSConfigRoles(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	cert, key := ca.leaf("server", "server.test")
+
+	tests := []struct {
+		in, out string
+		field   string
+	}{
+		{"tls://127.0.0.1:8443?cert=" + cert + "&key=" + key + "&ca=" + ca.file, "tcp://127.0.0.1:80", "in"},
+		{"tcp://127.0.0.1:8080", "tls://127.0.0.1:443?client_ca=" + ca.file, "out"},
+		{"tls://127.0.0.1:8443?cert=" + cert + "&key=" + key + "&client_ca=" + ca.file, "tls://127.0.0.1:443?ca=" + ca.file, ""},
+		// An agent dials its server, a reverse outbound listens for agents
+		{"agent+tls://127.0.0.1:7000?name=ssh&ca=" + ca.file, "tcp://127.0.0.1:22", ""},
+		{"tcp://127.0.0.1:2222", "reverse+tls://127.0.0.1:7000?name=ssh", "out"},
+		{"tcp://127.0.0.1:2222", "reverse+tls://127.0.0.1:7000?name=ssh&cert=" + cert + "&key=" + key + "&client_ca=" + ca.file, ""},
+	}
+	for _, tt := range tests {
+		c := TunnelConfig{Name: "web", In: tt.in, Out: tt.out}
+		err := c.Validate()
+		ce, _ := err.(*ConfigError)
+		if tt.field == "" && err != nil || tt.field != "" && (ce == nil || ce.Field != tt.field) {
+			t.Errorf("%s -> %s: error %v, want field %q", tt.in, tt.out, err, tt.field)
+		}
+	}
+
+	if _, err := ResolveAddr("tls://127.0.0.1:443?ca=" + filepath.Join(dir, "missing.pem")); err == nil {
+		t.Fatal("missing ca file accepted")
+	}
+}
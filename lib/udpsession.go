@@ -0,0 +1,213 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDP sessions are like NAT, one upstream socket for every client and destination,
+// replies are relayed back to client at any time until the session is idle for a timeout.
+// So QUIC, WireGuard, games and RTP keep working through the tunnel.
+
+// defaultUDPIdleTimeout close an idle udp session
+const defaultUDPIdleTimeout = 60 * time.Second
+
+// udpSessionQueue datagrams waiting to be sent of a session, more are dropped and counted
+const udpSessionQueue = 64
+
+// udpSession a client with its upstream socket
+type udpSession struct {
+	key     string
+	client  *net.UDPAddr
+	inConn  net.Conn
+	outConn net.Conn
+	to      *ProxyProtoAddr
+	// release the session counted by limiter
+	release func()
+	// shaper of replies, nil if not shaped
+	shaper *shaper
+	// queue datagrams to upstream, sent in order after the socket is dialed
+	queue chan []byte
+	// done closed when the session is closed
+	done chan struct{}
+
+	// lastActive unix nano of last datagram in any direction
+	lastActive int64
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+// udpSessionTable sessions of a tunnel keyed by client address and destination
+type udpSessionTable struct {
+	timeout   time.Duration
+	datagrams *datagramLimit
+	limiter   *connLimiter
+	dropped   *Counter
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	closed   bool
+}
+
+// newUDPSessionTable sessions expire after idle timeout, zero means 60s, new sessions are limited by limiter
+func newUDPSessionTable(tunnel string, timeout time.Duration, datagrams *datagramLimit, limiter *connLimiter) *udpSessionTable {
+	if timeout <= 0 {
+		timeout = defaultUDPIdleTimeout
+	}
+	return &udpSessionTable{
+		timeout:   timeout,
+		datagrams: datagrams,
+		limiter:   limiter,
+		dropped:   GetCounter(tunnel + ".udp_session_dropped"),
+		sessions:  make(map[string]*udpSession),
+	}
+}
+
+// forward queue the datagram of c to the session of its client, create one if not exists.
+// It does not block, the socket of a new session is dialed out of the lock.
+func (t *udpSessionTable) forward(c *ProxyChainConn, to *ProxyProtoAddr, dailer ProxyTunnelDialer) {
+	key := c.InUDPRemoteAddr.String() + " -> " + to.Addr
+	// The buffer of c is released after forward
+	data := append([]byte(nil), c.UDPData...)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	s := t.sessions[key]
+	if s == nil {
+		s = &udpSession{
+			key:     key,
+			client:  c.InUDPRemoteAddr,
+			inConn:  c.inConn,
+			to:      to,
+			release: func() {},
+			shaper:  c.shaper,
+			queue:   make(chan []byte, udpSessionQueue),
+			done:    make(chan struct{}),
+		}
+		t.sessions[key] = s
+		go t.open(s, dailer)
+	}
+
+	s.touch()
+	select {
+	case s.queue <- data:
+	default:
+		t.dropped.Add(1)
+		log.Warnf("drop udp %d bytes of %s to %s, %d datagrams queued, %d dropped", len(data), s.client, to.Addr, udpSessionQueue, t.dropped.Value())
+	}
+}
+
+// open the socket of a new session, then send its datagrams in order until it is closed
+func (t *udpSessionTable) open(s *udpSession, dailer ProxyTunnelDialer) {
+	release := func() {}
+	var conn net.Conn
+	var err error
+	if t.limiter != nil {
+		release, err = t.limiter.acquire(s.client, false)
+	}
+	if err == nil {
+		if conn, err = dialFor(context.Background(), dailer, s.client); err != nil {
+			release()
+		}
+	}
+
+	t.mu.Lock()
+	if err == nil && t.closed {
+		conn.Close()
+		release()
+		err = errors.New("tunnel stopped")
+	}
+	if err != nil {
+		if t.sessions[s.key] == s {
+			delete(t.sessions, s.key)
+		}
+		t.mu.Unlock()
+		close(s.done)
+		log.Errorf("open udp session of %s to %s failed: %s", s.client, s.to.Addr, err)
+		return
+	}
+	s.outConn, s.release = conn, release
+	t.mu.Unlock()
+
+	log.Infof("udp session opened %s <-> [%s, %s] <-> %s", s.client, s.inConn.LocalAddr(), conn.LocalAddr(), conn.RemoteAddr())
+	go t.relay(s)
+
+	for {
+		select {
+		case data := <-s.queue:
+			if n, err := conn.Write(data); n != len(data) || err != nil {
+				log.Errorf("send %d bytes to %s error: %v", len(data), s.to.Addr, err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// relay replies from upstream back to client, until the session is idle for timeout
+func (t *udpSessionTable) relay(s *udpSession) {
+	pbuf := t.datagrams.buffer()
+	defer t.datagrams.release(pbuf)
+	buf := *pbuf
+	replies := 0
+	for {
+		s.outConn.SetReadDeadline(time.Now().Add(t.timeout - s.idle()))
+		n, err := s.outConn.Read(buf)
+		if err != nil {
+			if opErr, ok := err.(net.Error); ok && opErr.Timeout() {
+				if s.idle() < t.timeout {
+					continue
+				}
+			} else if !errors.Is(err, net.ErrClosed) {
+				log.Errorf("read from %s for udp client %s error: %v", s.to.Addr, s.client, err)
+			}
+			break
+		}
+		s.touch()
+		if t.datagrams.isTruncated(n, s.outConn.RemoteAddr()) {
+			continue
+		}
+		if s.shaper != nil && !s.shaper.allowDatagram(s.client, n, false) {
+			continue
+		}
+		replies++
+		if w, err := s.inConn.(udpWriter).WriteToUDP(buf[:n], s.client); w != n || err != nil {
+			log.Errorf("write %d bytes(%d done) to %s, error: %v", n, w, s.client, err)
+		}
+	}
+
+	t.mu.Lock()
+	if t.sessions[s.key] == s {
+		delete(t.sessions, s.key)
+	}
+	t.mu.Unlock()
+	close(s.done)
+	s.outConn.Close()
+	s.release()
+	log.Infof("udp session closed %s <-> %s, %d replies", s.client, s.to.Addr, replies)
+}
+
+// Close all sessions, a session being opened is closed when dialed
+func (t *udpSessionTable) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for _, s := range t.sessions {
+		if s.outConn != nil {
+			s.outConn.Close()
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// funcDialer a connectionless dialer calling dial for every connection
+type funcDialer struct {
+	dial func() (net.Conn, error)
+}
+
+func (d *funcDialer) SetAddr(*ProxyProtoAddr)         {}
+func (d *funcDialer) SupportMultiplex() bool          { return false }
+func (d *funcDialer) IsConnectionless() bool          { return true }
+func (d *funcDialer) GetConn() (net.Conn, error)      { return d.dial() }
+func (d *funcDialer) GetStream() (interface{}, error) { return nil, errors.New("not support") }
+
+func TestUDPSessionDialOutOfLock(t *testing.T) {
+	echo := startUDPEcho(t)
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	to, _ := ResolveAddr("udp://" + echo.LocalAddr().String())
+
+	table := newUDPSessionTable(t.Name(), time.Second, newDatagramLimit(t.Name(), 0), nil)
+	defer table.Close()
+
+	// The dial for the first client blocks until the end of test
+	blocked := make(chan struct{})
+	defer close(blocked)
+	slow := &funcDialer{dial: func() (net.Conn, error) {
+		<-blocked
+		return nil, errors.New("stopped")
+	}}
+	fast := &funcDialer{dial: func() (net.Conn, error) { return net.Dial("udp", echo.LocalAddr().String()) }}
+
+	clients := make([]*net.UDPConn, 2)
+	for i := range clients {
+		if clients[i], err = net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+		defer clients[i].Close()
+	}
+
+	forwarded := make(chan struct{})
+	go func() {
+		table.forward(&ProxyChainConn{inConn: server, InUDPRemoteAddr: clients[0].LocalAddr().(*net.UDPAddr), UDPData: []byte("slow")}, to, slow)
+		table.forward(&ProxyChainConn{inConn: server, InUDPRemoteAddr: clients[1].LocalAddr().(*net.UDPAddr), UDPData: []byte("fast")}, to, fast)
+		close(forwarded)
+	}()
+	select {
+	case <-forwarded:
+	case <-time.After(2 * time.Second):
+		t.Fatal("forward blocked by a slow dial")
+	}
+
+	// The reply of the second client comes back by the server socket
+	buf := make([]byte, 16)
+	clients[1].SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := clients[1].Read(buf)
+	if err != nil || string(buf[:n]) != "fast" {
+		t.Fatalf("reply %q %v", buf[:n], err)
+	}
+}
+
+func TestUDPSessionOrder(t *testing.T) {
+	// The upstream records datagrams in the order of receiving
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	const count = 50
+	received := make(chan []string, 1)
+	go func() {
+		var got []string
+		buf := make([]byte, 64)
+		for len(got) < count {
+			upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := upstream.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			got = append(got, string(buf[:n]))
+		}
+		received <- got
+	}()
+
+	in := freeAddr(t, "udp")
+	startTunnel(t, ProxyChainTunnel{InAddr: "udp://" + in, OutAddr: "udp://" + upstream.LocalAddr().String()})
+
+	conn, err := net.Dial("udp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(conn, "%d", i)
+	}
+
+	got := <-received
+	if len(got) != count {
+		t.Fatalf("upstream received %d datagrams, want %d", len(got), count)
+	}
+	for i, s := range got {
+		if s != fmt.Sprint(i) {
+			t.Fatalf("datagram %d is %s, out of order: %v", i, s, got)
+		}
+	}
+}